@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteTable is the routing state exposed on /admin/routes: the hop of
+// every node per path, as consulted by getNextTarget, and the downstream
+// services called by /all and /random
+type RouteTable struct {
+	Services []string                  `json:"services,omitempty"`
+	Paths    map[string]map[string]Hop `json:"paths"`
+	Targets  []string                  `json:"targets"`
+}
+
+// routeTablePatch is a JSON merge patch (RFC 7396) of a RouteTable:
+// a null path removes the path, a null hop removes the node from its path
+// and a targets list replaces the downstream services
+type routeTablePatch struct {
+	Services *[]string                  `json:"services"`
+	Paths    map[string]map[string]*Hop `json:"paths"`
+	Targets  *[]string                  `json:"targets"`
+}
+
+type adminRoutes struct {
+	paths   *PathRoutes
+	targets *Targets
+}
+
+// registerAdminRoutes adds the routing table API to r:
+//
+//	GET    /admin/routes                   current routing table
+//	PUT    /admin/routes                   replace the routing table
+//	PATCH  /admin/routes                   merge a JSON merge patch into the routing table
+//	DELETE /admin/routes/paths/{pathId}    remove a path
+//	PUT    /admin/routes/targets/{target}  add a downstream service
+//	DELETE /admin/routes/targets/{target}  remove a downstream service
+func registerAdminRoutes(r *mux.Router, paths *PathRoutes, targets *Targets) {
+	admin := &adminRoutes{paths: paths, targets: targets}
+
+	r.Methods("GET").Path("/admin/routes").HandlerFunc(admin.get)
+	r.Methods("PUT").Path("/admin/routes").HandlerFunc(admin.put)
+	r.Methods("PATCH").Path("/admin/routes").HandlerFunc(admin.patch)
+	r.Methods("DELETE").Path("/admin/routes/paths/{pathId}").HandlerFunc(admin.deletePath)
+	r.Methods("PUT").Path("/admin/routes/targets/{target}").HandlerFunc(admin.addTarget)
+	r.Methods("DELETE").Path("/admin/routes/targets/{target}").HandlerFunc(admin.deleteTarget)
+}
+
+// registerAdminQueue adds the work queue counters to r:
+//
+//	GET    /admin/queue                    queue depth, wait time and rejections
+func registerAdminQueue(r *mux.Router, queue *WorkQueue) {
+	r.Methods("GET").Path("/admin/queue").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, queue.Stats())
+	})
+}
+
+// registerAdminLimits adds the rate limiter counters to r:
+//
+//	GET    /admin/limits                   allowed and throttled requests per endpoint
+func registerAdminLimits(r *mux.Router, limiter *RateLimiter) {
+	r.Methods("GET").Path("/admin/limits").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, limiter.Stats())
+	})
+}
+
+// registerAdminBreakers adds the circuit breakers of the downstream services to r:
+//
+//	GET    /admin/breakers                 state and failure counters per target
+func registerAdminBreakers(r *mux.Router) {
+	r.Methods("GET").Path("/admin/breakers").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, breakerStats())
+	})
+}
+
+// registerAdminMemory adds the memory of the process to r:
+//
+//	GET    /admin/memory                   ballast size, resident memory, heap and GC counters
+func registerAdminMemory(r *mux.Router, ballast *Ballast) {
+	r.Methods("GET").Path("/admin/memory").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ballast.Stats())
+	})
+}
+
+// registerAdminFunctions adds the objective functions of the performance model to r:
+//
+//	GET    /admin/functions                function of every resource and registered functions, with their domains
+func registerAdminFunctions(r *mux.Router) {
+	r.Methods("GET").Path("/admin/functions").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registered := make([]*Objective, 0, len(objectives))
+		for _, name := range objectiveNames() {
+			registered = append(registered, objectives[name])
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"selected":   selectedObjectives(),
+			"registered": registered,
+		})
+	})
+}
+
+func (a *adminRoutes) table() RouteTable {
+	topology := a.paths.Topology()
+	return RouteTable{
+		Services: topology.Services,
+		Paths:    topology.Paths,
+		Targets:  a.targets.List(),
+	}
+}
+
+func (a *adminRoutes) get(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.table())
+}
+
+func (a *adminRoutes) put(w http.ResponseWriter, r *http.Request) {
+	var table RouteTable
+	if err := json.NewDecoder(r.Body).Decode(&table); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err := a.paths.Update(func(topology *Topology) error {
+		topology.Services = table.Services
+		topology.Paths = table.Paths
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.targets.Set(table.Targets)
+
+	log.Printf("admin: routing table replaced\n")
+	writeJSON(w, http.StatusOK, a.table())
+}
+
+func (a *adminRoutes) patch(w http.ResponseWriter, r *http.Request) {
+	var patch routeTablePatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err := a.paths.Update(func(topology *Topology) error {
+		if patch.Services != nil {
+			topology.Services = *patch.Services
+		}
+		for pathId, hops := range patch.Paths {
+			if hops == nil {
+				delete(topology.Paths, pathId)
+				continue
+			}
+			route, ok := topology.Paths[pathId]
+			if !ok {
+				route = map[string]Hop{}
+				topology.Paths[pathId] = route
+			}
+			for node, hop := range hops {
+				if hop == nil {
+					delete(route, node)
+				} else {
+					route[node] = *hop
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if patch.Targets != nil {
+		a.targets.Set(*patch.Targets)
+	}
+
+	log.Printf("admin: routing table patched\n")
+	writeJSON(w, http.StatusOK, a.table())
+}
+
+func (a *adminRoutes) deletePath(w http.ResponseWriter, r *http.Request) {
+	pathId := mux.Vars(r)["pathId"]
+
+	_, err := a.paths.Update(func(topology *Topology) error {
+		if _, ok := topology.Paths[pathId]; !ok {
+			return errNotFound
+		}
+		delete(topology.Paths, pathId)
+		return nil
+	})
+	if err == errNotFound {
+		http.Error(w, fmt.Sprintf("path %s not found", pathId), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("admin: path %s removed\n", pathId)
+	writeJSON(w, http.StatusOK, a.table())
+}
+
+func (a *adminRoutes) addTarget(w http.ResponseWriter, r *http.Request) {
+	target := mux.Vars(r)["target"]
+
+	if a.targets.Add(target) {
+		log.Printf("admin: target %s added\n", target)
+	}
+	writeJSON(w, http.StatusOK, a.table())
+}
+
+func (a *adminRoutes) deleteTarget(w http.ResponseWriter, r *http.Request) {
+	target := mux.Vars(r)["target"]
+
+	if !a.targets.Remove(target) {
+		http.Error(w, fmt.Sprintf("target %s not found", target), http.StatusNotFound)
+		return
+	}
+	log.Printf("admin: target %s removed\n", target)
+	writeJSON(w, http.StatusOK, a.table())
+}
+
+// faultTable is the fault state exposed on /admin/faults: the faults set on the
+// command line or through the API, and those of the served topology
+type faultTable struct {
+	Faults   []Fault `json:"faults"`
+	Topology []Fault `json:"topology"`
+}
+
+// registerAdminFaults adds the fault injection API to r:
+//
+//	GET    /admin/faults                   faults injected into the requests
+//	PUT    /admin/faults                   replace the faults with a JSON list
+//	POST   /admin/faults                   add a fault
+//	DELETE /admin/faults                   remove the faults, those of the topology file stay
+func registerAdminFaults(r *mux.Router, injector *FaultInjector) {
+	table := func() faultTable {
+		topology := []Fault{}
+		if injector.paths != nil {
+			topology = append(topology, injector.paths.Topology().Faults...)
+		}
+		return faultTable{Faults: injector.List(), Topology: topology}
+	}
+
+	r.Methods("GET").Path("/admin/faults").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, table())
+	})
+	r.Methods("PUT").Path("/admin/faults").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var faults []Fault
+		if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := injector.Set(faults); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("admin: faults replaced\n")
+		writeJSON(w, http.StatusOK, table())
+	})
+	r.Methods("POST").Path("/admin/faults").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var fault Fault
+		if err := json.NewDecoder(r.Body).Decode(&fault); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := injector.Add(fault); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("admin: fault %s added\n", fault.Type)
+		writeJSON(w, http.StatusOK, table())
+	})
+	r.Methods("DELETE").Path("/admin/faults").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		injector.Set(nil)
+		log.Printf("admin: faults removed\n")
+		writeJSON(w, http.StatusOK, table())
+	})
+}
+
+var errNotFound = fmt.Errorf("not found")
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing response: %v\n", err)
+	}
+}
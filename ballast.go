@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	memoryChurn         float64
+	memoryChurnInterval time.Duration
+)
+
+// Ballast is the memory held by the service, in units of epsilon MiB: the units
+// derived from the parameters scaled by the memory load profile. Every page of
+// the ballast is written so it is resident, not only reserved
+type Ballast struct {
+	mux     sync.Mutex
+	chunks  [][]byte
+	base    uint
+	factor  float64
+	random  *rand.Rand
+	churned uint64
+}
+
+// BallastStats is the memory of the process exposed on /admin/memory
+type BallastStats struct {
+	Units          uint   `json:"units"`
+	BallastBytes   uint64 `json:"ballastBytes"`
+	ResidentBytes  uint64 `json:"residentBytes,omitempty"`
+	HeapAllocBytes uint64 `json:"heapAllocBytes"`
+	HeapSysBytes   uint64 `json:"heapSysBytes"`
+	SysBytes       uint64 `json:"sysBytes"`
+	NumGC          uint32 `json:"numGc"`
+	ChurnedBytes   uint64 `json:"churnedBytes"`
+}
+
+func NewBallast() *Ballast {
+	return &Ballast{factor: 1, random: rand.New(rand.NewSource(randomSeed))}
+}
+
+// SetBase sets the units derived from the parameters and resizes the ballast
+func (m *Ballast) SetBase(units uint) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.base = units
+	m.resize()
+}
+
+// Scale sets the factor of the memory load profile and resizes the ballast
+func (m *Ballast) Scale(factor float64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.factor = factor
+	m.resize()
+}
+
+// resize grows or shrinks the ballast to base * factor units. Dropped chunks
+// are collected and returned to the operating system right away
+func (m *Ballast) resize() {
+	units := uint(math.Round(float64(m.base) * m.factor))
+	if units == uint(len(m.chunks)) {
+		return
+	}
+
+	for i := uint(len(m.chunks)); i < units; i++ {
+		m.chunks = append(m.chunks, newChunk())
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	if units < uint(len(m.chunks)) {
+		for i := units; i < uint(len(m.chunks)); i++ {
+			m.chunks[i] = nil
+		}
+		m.chunks = m.chunks[:units]
+		debug.FreeOSMemory()
+	}
+	memUsage(units)
+}
+
+// newChunk allocates a unit and writes one byte per page, so the operating
+// system commits all of it
+func newChunk() []byte {
+	chunk := make([]byte, epsilon*1024*1024)
+	for i := 0; i < len(chunk); i += os.Getpagesize() {
+		chunk[i] = 1
+	}
+	return chunk
+}
+
+// Units returns the number of units held
+func (m *Ballast) Units() uint {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return uint(len(m.chunks))
+}
+
+// Churn replaces fraction of the units by new ones, leaving the old ones to the GC
+func (m *Ballast) Churn(fraction float64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	count := int(math.Ceil(float64(len(m.chunks)) * math.Min(1, fraction)))
+	for _, i := range m.random.Perm(len(m.chunks))[:count] {
+		m.chunks[i] = newChunk()
+	}
+	atomic.AddUint64(&m.churned, uint64(count*epsilon*1024*1024))
+}
+
+// Churned returns the bytes of ballast replaced so far
+func (m *Ballast) Churned() uint64 {
+	return atomic.LoadUint64(&m.churned)
+}
+
+// Stats returns the size of the ballast with the memory of the process
+func (m *Ballast) Stats() BallastStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	units := m.Units()
+	stats := BallastStats{
+		Units:          units,
+		BallastBytes:   uint64(units) * uint64(epsilon) * 1024 * 1024,
+		HeapAllocBytes: mem.HeapAlloc,
+		HeapSysBytes:   mem.HeapSys,
+		SysBytes:       mem.Sys,
+		NumGC:          mem.NumGC,
+		ChurnedBytes:   m.Churned(),
+	}
+	if rss, ok := residentMemory(); ok {
+		stats.ResidentBytes = rss
+	}
+	return stats
+}
+
+// runChurn replaces fraction of the ballast every interval, until the process ends,
+// to put the GC under pressure
+func runChurn(ballast *Ballast, fraction float64, interval time.Duration) {
+	log.Printf("churning %.0f%% of the memory every %v\n", fraction*100, interval)
+	for range time.Tick(interval) {
+		ballast.Churn(fraction)
+	}
+}
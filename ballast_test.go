@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+var unitBytes = uint64(epsilon) * 1024 * 1024
+
+func TestBallastResize(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   uint
+		factor float64
+		units  uint
+	}{
+		{name: "base", base: 3, factor: 1, units: 3},
+		{name: "scaled up", base: 3, factor: 2, units: 6},
+		{name: "scaled down and rounded", base: 3, factor: 0.5, units: 2},
+		{name: "shrunk base", base: 1, factor: 0.5, units: 1},
+		{name: "nothing", base: 0, factor: 2, units: 0},
+		{name: "grown again", base: 2, factor: 1, units: 2},
+	}
+
+	// the steps run in order on the same ballast
+	ballast := NewBallast()
+	for _, test := range tests {
+		ballast.SetBase(test.base)
+		ballast.Scale(test.factor)
+		if units := ballast.Units(); units != test.units {
+			t.Fatalf("%s: Units() = %d, want %d", test.name, units, test.units)
+		}
+		stats := ballast.Stats()
+		if stats.Units != test.units || stats.BallastBytes != uint64(test.units)*unitBytes {
+			t.Errorf("%s: Stats() = %d units, %d bytes, want %d units, %d bytes",
+				test.name, stats.Units, stats.BallastBytes, test.units, uint64(test.units)*unitBytes)
+		}
+		for i, chunk := range ballast.chunks {
+			if uint64(len(chunk)) != unitBytes || chunk[0] != 1 {
+				t.Fatalf("%s: chunk %d has %d bytes, first byte %d, want %d written bytes", test.name, i, len(chunk), chunk[0], unitBytes)
+			}
+		}
+	}
+}
+
+func TestBallastChurn(t *testing.T) {
+	ballast := NewBallast()
+	ballast.SetBase(4)
+	before := append([][]byte(nil), ballast.chunks...)
+
+	ballast.Churn(0.5)
+	replaced := 0
+	for i := range before {
+		if &before[i][0] != &ballast.chunks[i][0] {
+			replaced++
+		}
+	}
+	if replaced != 2 {
+		t.Errorf("Churn(0.5) replaced %d of 4 units, want 2", replaced)
+	}
+	if churned := ballast.Churned(); churned != 2*unitBytes {
+		t.Errorf("Churned() = %d, want %d", churned, 2*unitBytes)
+	}
+
+	// churn never replaces more than the whole ballast, nor changes its size
+	ballast.Churn(3)
+	if churned := ballast.Churned(); churned != 6*unitBytes {
+		t.Errorf("Churned() = %d after Churn(3), want %d", churned, 6*unitBytes)
+	}
+	if units := ballast.Units(); units != 4 {
+		t.Errorf("Units() = %d after churning, want 4", units)
+	}
+	if churned := ballast.Stats().ChurnedBytes; churned != 6*unitBytes {
+		t.Errorf("Stats().ChurnedBytes = %d, want %d", churned, 6*unitBytes)
+	}
+}
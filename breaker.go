@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+
+	fallbackEmpty  = "empty"
+	fallbackCached = "cached"
+	fallbackReject = "503"
+)
+
+// BreakerPolicy tells when the breaker of a downstream service opens and what
+// the calls get while it is open
+type BreakerPolicy struct {
+	// Failures opens the breaker after that many consecutive failed calls, 0 disables it
+	Failures int
+	// ErrorRate opens the breaker when the percentage of failed calls in a window reaches it, 0 disables it
+	ErrorRate float64
+	// Window is the period over which the error rate is computed
+	Window time.Duration
+	// MinRequests is the number of calls in a window before the error rate is considered
+	MinRequests int
+	// OpenTime is how long the breaker stays open before letting probes through
+	OpenTime time.Duration
+	// Probes is the number of successful calls in half-open state that close the breaker
+	Probes int
+	// Fallback is the answer while the breaker is open: empty, cached or 503
+	Fallback string
+}
+
+var defaultBreakerPolicy = BreakerPolicy{
+	Failures:    5,
+	ErrorRate:   50,
+	Window:      10 * time.Second,
+	MinRequests: 20,
+	OpenTime:    5 * time.Second,
+	Probes:      1,
+	Fallback:    fallbackReject,
+}
+
+// CircuitBreaker stops calling a failing downstream service for a while.
+// A closed breaker lets every call through and opens when the failure thresholds
+// are reached; an open breaker answers with the fallback until OpenTime has passed,
+// then goes half-open and lets Probes calls through: their success closes it,
+// any failure opens it again. The outcome of a call let through before the
+// breaker last changed state is left out.
+type CircuitBreaker struct {
+	target string
+	policy BreakerPolicy
+
+	mux         sync.Mutex
+	state       string
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	generation  uint64
+	probing     int
+	probed      int
+	cached      []byte
+	opened      uint64
+	rejected    uint64
+}
+
+// BreakerStats is a snapshot of a breaker
+type BreakerStats struct {
+	Target              string  `json:"target"`
+	State               string  `json:"state"`
+	ConsecutiveFailures int     `json:"consecutiveFailures"`
+	Requests            int     `json:"requests"`
+	Failures            int     `json:"failures"`
+	ErrorRate           float64 `json:"errorRate"`
+	Opened              uint64  `json:"opened"`
+	Rejected            uint64  `json:"rejected"`
+	Fallback            string  `json:"fallback"`
+}
+
+// breakerCall is a call let through by Allow, its outcome is given back to Record or Release
+type breakerCall struct {
+	// generation is the number of state changes of the breaker when the call was let through
+	generation uint64
+	probe      bool
+}
+
+func newCircuitBreaker(target string, policy BreakerPolicy) *CircuitBreaker {
+	return &CircuitBreaker{target: target, policy: policy, state: breakerClosed, windowStart: time.Now()}
+}
+
+// Allow reports whether a call may go to the target and, if so, returns the call
+func (b *CircuitBreaker) Allow() (breakerCall, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.policy.OpenTime {
+		b.setState(breakerHalfOpen)
+	}
+	call := breakerCall{generation: b.generation}
+	switch b.state {
+	case breakerOpen:
+		b.rejected++
+		return call, false
+	case breakerHalfOpen:
+		if b.probing+b.probed >= b.policy.Probes {
+			b.rejected++
+			return call, false
+		}
+		b.probing++
+		call.probe = true
+	}
+	return call, true
+}
+
+// Record counts the outcome of call, let through by Allow; body is kept for the cached fallback
+func (b *CircuitBreaker) Record(call breakerCall, success bool, body []byte) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if success {
+		b.cached = body
+	}
+	// the call was let through before the breaker tripped or closed, it is not
+	// one of the probes and says nothing about the current state
+	if call.generation != b.generation {
+		return
+	}
+	if call.probe {
+		b.probing--
+		if !success {
+			b.trip()
+			return
+		}
+		b.probed++
+		if b.probed >= b.policy.Probes {
+			b.setState(breakerClosed)
+		}
+	}
+
+	if time.Since(b.windowStart) > b.policy.Window {
+		b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+	}
+	b.requests++
+	if success {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+
+	if b.state != breakerClosed {
+		return
+	}
+	if b.policy.Failures > 0 && b.consecutive >= b.policy.Failures {
+		b.trip()
+	} else if b.policy.ErrorRate > 0 && b.requests >= b.policy.MinRequests &&
+		float64(b.failures)*100/float64(b.requests) >= b.policy.ErrorRate {
+		b.trip()
+	}
+}
+
+// Release gives back the slot of call, let through by Allow, that ended without an
+// outcome, e.g. cancelled by the client, so a half-open breaker can probe again
+func (b *CircuitBreaker) Release(call breakerCall) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if call.probe && call.generation == b.generation {
+		b.probing--
+	}
+}
+
+// Fallback returns the answer to a call rejected by an open breaker
+func (b *CircuitBreaker) Fallback() ([]byte, int) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	switch b.policy.Fallback {
+	case fallbackEmpty:
+		return []byte{}, http.StatusOK
+	case fallbackCached:
+		if b.cached != nil {
+			return b.cached, http.StatusOK
+		}
+	}
+	return []byte{0}, http.StatusServiceUnavailable
+}
+
+func (b *CircuitBreaker) trip() {
+	b.setState(breakerOpen)
+	b.openedAt = time.Now()
+	b.opened++
+}
+
+func (b *CircuitBreaker) setState(state string) {
+	log.Printf("circuit breaker of %s: %s -> %s\n", b.target, b.state, state)
+	b.state = state
+	b.generation++
+	b.probing, b.probed = 0, 0
+	if state == breakerClosed {
+		b.consecutive = 0
+		b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+	}
+}
+
+// Stats returns a snapshot of the breaker
+func (b *CircuitBreaker) Stats() BreakerStats {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	stats := BreakerStats{
+		Target:              b.target,
+		State:               b.state,
+		ConsecutiveFailures: b.consecutive,
+		Requests:            b.requests,
+		Failures:            b.failures,
+		Opened:              b.opened,
+		Rejected:            b.rejected,
+		Fallback:            b.policy.Fallback,
+	}
+	if b.requests > 0 {
+		stats.ErrorRate = float64(b.failures) * 100 / float64(b.requests)
+	}
+	return stats
+}
+
+var (
+	breakerPolicies = breakerFlag{}
+	breakersMux     sync.Mutex
+	breakers        = map[string]*CircuitBreaker{}
+)
+
+// breakerFor returns the breaker of target, nil if no breaker policy applies to it
+func breakerFor(target string) *CircuitBreaker {
+	policy, ok := breakerPolicies.get(target)
+	if !ok {
+		return nil
+	}
+
+	breakersMux.Lock()
+	defer breakersMux.Unlock()
+	breaker, ok := breakers[target]
+	if !ok {
+		breaker = newCircuitBreaker(target, policy)
+		breakers[target] = breaker
+	}
+	return breaker
+}
+
+// breakerStats returns the snapshot of every breaker created so far, sorted by target
+func breakerStats() []BreakerStats {
+	breakersMux.Lock()
+	stats := make([]BreakerStats, 0, len(breakers))
+	for _, breaker := range breakers {
+		stats = append(stats, breaker.Stats())
+	}
+	breakersMux.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Target < stats[j].Target })
+	return stats
+}
+
+// breakerFlag collects the breaker policies given on the command line as
+// [target:]key=value,... with the keys failures, error-rate, window, min-requests,
+// open, probes and fallback, e.g. failures=3,fallback=cached for every target or
+// svc-1-mock:error-rate=20 for one. Keys left out keep the value of the default
+// policy given before. Targets without a policy have no breaker.
+type breakerFlag map[string]BreakerPolicy
+
+func (f breakerFlag) get(target string) (BreakerPolicy, bool) {
+	if policy, ok := f[target]; ok {
+		return policy, true
+	}
+	policy, ok := f[""]
+	return policy, ok
+}
+
+func (f breakerFlag) String() string {
+	policies := make([]string, 0, len(f))
+	for target, policy := range f {
+		spec := fmt.Sprintf("failures=%d,error-rate=%g,window=%v,min-requests=%d,open=%v,probes=%d,fallback=%s",
+			policy.Failures, policy.ErrorRate, policy.Window, policy.MinRequests, policy.OpenTime, policy.Probes, policy.Fallback)
+		if target != "" {
+			spec = target + ":" + spec
+		}
+		policies = append(policies, spec)
+	}
+	sort.Strings(policies)
+	return strings.Join(policies, " ")
+}
+
+func (f breakerFlag) Set(value string) error {
+	target := ""
+	if kv := strings.SplitN(value, ":", 2); len(kv) == 2 && !strings.Contains(kv[0], "=") {
+		target, value = kv[0], kv[1]
+	}
+
+	policy, ok := f.get("")
+	if !ok {
+		policy = defaultBreakerPolicy
+	}
+	if strings.TrimSpace(value) == "" {
+		f[target] = policy
+		return nil
+	}
+	for _, param := range strings.Split(value, ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("parameter %s is not key=value", param)
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		var err error
+		switch key {
+		case "failures":
+			policy.Failures, err = strconv.Atoi(val)
+		case "error-rate":
+			policy.ErrorRate, err = strconv.ParseFloat(val, 64)
+			if err == nil && (policy.ErrorRate < 0 || policy.ErrorRate > 100) {
+				err = fmt.Errorf("must be a percentage")
+			}
+		case "window":
+			policy.Window, err = time.ParseDuration(val)
+		case "min-requests":
+			policy.MinRequests, err = strconv.Atoi(val)
+		case "open":
+			policy.OpenTime, err = time.ParseDuration(val)
+		case "probes":
+			policy.Probes, err = strconv.Atoi(val)
+			if err == nil && policy.Probes < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "fallback":
+			policy.Fallback = val
+			if val != fallbackEmpty && val != fallbackCached && val != fallbackReject {
+				err = fmt.Errorf("must be %s, %s or %s", fallbackEmpty, fallbackCached, fallbackReject)
+			}
+		default:
+			return fmt.Errorf("unknown breaker parameter %s", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	f[target] = policy
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// breakerStep is one call to a breaker: allow checks Allow, success and failure
+// record the outcome of the oldest call allowed, or of a new call if there is
+// none, and release gives the slot of the oldest call allowed back
+type breakerStep struct {
+	op    string
+	allow bool
+	state string
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	consecutive := BreakerPolicy{Failures: 2, Window: time.Minute, OpenTime: time.Hour, Probes: 1, Fallback: fallbackReject}
+	// OpenTime 0 lets a probe through on the first call after the breaker opens
+	probing := BreakerPolicy{Failures: 1, Window: time.Minute, Probes: 2, Fallback: fallbackReject}
+	rate := BreakerPolicy{ErrorRate: 50, Window: time.Minute, MinRequests: 4, OpenTime: time.Hour, Probes: 1, Fallback: fallbackReject}
+
+	tests := []struct {
+		name   string
+		policy BreakerPolicy
+		steps  []breakerStep
+	}{
+		{
+			name:   "consecutive failures open the breaker",
+			policy: consecutive,
+			steps: []breakerStep{
+				{op: "allow", allow: true},
+				{op: "failure", state: breakerClosed},
+				{op: "allow", allow: true},
+				{op: "failure", state: breakerOpen},
+				{op: "allow", allow: false, state: breakerOpen},
+			},
+		},
+		{
+			name:   "a success resets the consecutive failures",
+			policy: consecutive,
+			steps: []breakerStep{
+				{op: "failure", state: breakerClosed},
+				{op: "success", state: breakerClosed},
+				{op: "failure", state: breakerClosed},
+				{op: "allow", allow: true, state: breakerClosed},
+			},
+		},
+		{
+			name:   "error rate opens the breaker after min requests",
+			policy: rate,
+			steps: []breakerStep{
+				{op: "failure", state: breakerClosed},
+				{op: "failure", state: breakerClosed},
+				{op: "success", state: breakerClosed},
+				{op: "failure", state: breakerOpen},
+			},
+		},
+		{
+			name:   "successful probes close the breaker",
+			policy: probing,
+			steps: []breakerStep{
+				{op: "failure", state: breakerOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "allow", allow: false, state: breakerHalfOpen},
+				{op: "success", state: breakerHalfOpen},
+				{op: "success", state: breakerClosed},
+				{op: "allow", allow: true, state: breakerClosed},
+			},
+		},
+		{
+			name:   "a failed probe opens the breaker again",
+			policy: probing,
+			steps: []breakerStep{
+				{op: "failure", state: breakerOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "failure", state: breakerOpen},
+			},
+		},
+		{
+			name:   "a cancelled probe gives its slot back",
+			policy: BreakerPolicy{Failures: 1, Window: time.Minute, Probes: 1, Fallback: fallbackReject},
+			steps: []breakerStep{
+				{op: "failure", state: breakerOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "allow", allow: false, state: breakerHalfOpen},
+				{op: "release", state: breakerHalfOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "success", state: breakerClosed},
+			},
+		},
+		{
+			name:   "calls let through before the breaker opened are not probes",
+			policy: BreakerPolicy{Failures: 1, Window: time.Minute, Probes: 1, Fallback: fallbackReject},
+			steps: []breakerStep{
+				{op: "allow", allow: true, state: breakerClosed},
+				{op: "allow", allow: true, state: breakerClosed},
+				{op: "failure", state: breakerOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				// the second call of the closed state ends, the probe is still running
+				{op: "success", state: breakerHalfOpen},
+				{op: "allow", allow: false, state: breakerHalfOpen},
+				{op: "success", state: breakerClosed},
+			},
+		},
+		{
+			name:   "a late failure does not open the breaker again",
+			policy: BreakerPolicy{Failures: 1, Window: time.Minute, Probes: 1, Fallback: fallbackReject},
+			steps: []breakerStep{
+				{op: "allow", allow: true, state: breakerClosed},
+				{op: "allow", allow: true, state: breakerClosed},
+				{op: "failure", state: breakerOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "failure", state: breakerHalfOpen},
+				{op: "release", state: breakerHalfOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+			},
+		},
+		{
+			name:   "release outside half-open state changes nothing",
+			policy: consecutive,
+			steps: []breakerStep{
+				{op: "allow", allow: true},
+				{op: "release", state: breakerClosed},
+				{op: "failure", state: breakerClosed},
+				{op: "failure", state: breakerOpen},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breaker := newCircuitBreaker("svc-1", test.policy)
+			pending := []breakerCall{}
+			next := func(i int) breakerCall {
+				if len(pending) == 0 {
+					call, allowed := breaker.Allow()
+					if !allowed {
+						t.Fatalf("step %d: Allow() = false, want a call to record", i)
+					}
+					return call
+				}
+				call := pending[0]
+				pending = pending[1:]
+				return call
+			}
+			for i, step := range test.steps {
+				switch step.op {
+				case "allow":
+					call, allowed := breaker.Allow()
+					if allowed != step.allow {
+						t.Fatalf("step %d: Allow() = %v, want %v", i, allowed, step.allow)
+					}
+					if allowed {
+						pending = append(pending, call)
+					}
+				case "success":
+					breaker.Record(next(i), true, []byte("ok"))
+				case "failure":
+					breaker.Record(next(i), false, nil)
+				case "release":
+					breaker.Release(next(i))
+				}
+				if state := breaker.Stats().State; step.state != "" && state != step.state {
+					t.Fatalf("step %d (%s): state = %s, want %s", i, step.op, state, step.state)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback string
+		cached   []byte
+		body     string
+		status   int
+	}{
+		{name: "reject", fallback: fallbackReject, status: http.StatusServiceUnavailable, body: "\x00"},
+		{name: "empty", fallback: fallbackEmpty, status: http.StatusOK, body: ""},
+		{name: "cached", fallback: fallbackCached, cached: []byte("last"), status: http.StatusOK, body: "last"},
+		{name: "cached without a success", fallback: fallbackCached, status: http.StatusServiceUnavailable, body: "\x00"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breaker := newCircuitBreaker("svc-1", BreakerPolicy{Failures: 1, Window: time.Minute, OpenTime: time.Hour, Probes: 1, Fallback: test.fallback})
+			if test.cached != nil {
+				call, _ := breaker.Allow()
+				breaker.Record(call, true, test.cached)
+			}
+			call, _ := breaker.Allow()
+			breaker.Record(call, false, nil)
+
+			body, status := breaker.Fallback()
+			if status != test.status || string(body) != test.body {
+				t.Errorf("Fallback() = %q, %d, want %q, %d", body, status, test.body, test.status)
+			}
+		})
+	}
+}
+
+func TestBreakerFlag(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		target string
+		want   BreakerPolicy
+		ok     bool
+		err    bool
+	}{
+		{
+			name:   "default policy",
+			values: []string{""},
+			target: "svc-1",
+			want:   defaultBreakerPolicy,
+			ok:     true,
+		},
+		{
+			name:   "keys override the default",
+			values: []string{"failures=3,fallback=cached,open=1s"},
+			target: "svc-1",
+			want: BreakerPolicy{Failures: 3, ErrorRate: 50, Window: 10 * time.Second, MinRequests: 20,
+				OpenTime: time.Second, Probes: 1, Fallback: fallbackCached},
+			ok: true,
+		},
+		{
+			name:   "target policy starts from the default given before",
+			values: []string{"failures=3", "svc-2:error-rate=20"},
+			target: "svc-2",
+			want: BreakerPolicy{Failures: 3, ErrorRate: 20, Window: 10 * time.Second, MinRequests: 20,
+				OpenTime: 5 * time.Second, Probes: 1, Fallback: fallbackReject},
+			ok: true,
+		},
+		{
+			name:   "targets without a policy have no breaker",
+			values: []string{"svc-2:failures=3"},
+			target: "svc-1",
+			ok:     false,
+		},
+		{name: "unknown key", values: []string{"retries=3"}, err: true},
+		{name: "not key=value", values: []string{"failures"}, err: true},
+		{name: "error rate above 100", values: []string{"error-rate=150"}, err: true},
+		{name: "no probes", values: []string{"probes=0"}, err: true},
+		{name: "unknown fallback", values: []string{"fallback=retry"}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flag := breakerFlag{}
+			var err error
+			for _, value := range test.values {
+				if err = flag.Set(value); err != nil {
+					break
+				}
+			}
+			if test.err {
+				if err == nil {
+					t.Fatalf("Set(%v) returned no error", test.values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Set(%v) error = %v", test.values, err)
+			}
+
+			policy, ok := flag.get(test.target)
+			if ok != test.ok || (ok && policy != test.want) {
+				t.Errorf("get(%s) = %+v, %v, want %+v, %v", test.target, policy, ok, test.want, test.ok)
+			}
+		})
+	}
+}
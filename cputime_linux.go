@@ -0,0 +1,18 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// RUSAGE_THREAD is not exported by the syscall package
+const rusageThread = 1
+
+// threadCpuTime returns the user and system CPU time used by the calling thread
+func threadCpuTime() (time.Duration, bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(rusageThread, &usage); err != nil {
+		return 0, false
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), true
+}
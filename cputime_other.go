@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "time"
+
+// threadCpuTime is only available on linux
+func threadCpuTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Distribution draws non-negative samples around a configured mean
+type Distribution interface {
+	Sample() float64
+	String() string
+}
+
+// newDistribution builds a distribution from a spec of the form
+// name[:key=value,...], using mean where the spec leaves it open:
+//
+//	constant                               always mean
+//	normal:stddev=10                       normal around mean
+//	exponential                            exponential with mean
+//	lognormal:sigma=1                      log-normal with mean
+//	pareto:alpha=3                         Pareto with mean, alpha > 1
+//	bimodal:low=5,high=50,p=0.5,stddev=1   normal around low with probability p, around high otherwise
+//	empirical:file=histogram.csv           values drawn from a "value,weight" file
+//
+// Samples come from their own generator seeded with seed, so runs are reproducible.
+func newDistribution(spec string, mean float64, seed int64) (Distribution, error) {
+	name, params, err := parseDistributionSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range params {
+		if key != "file" {
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("%s: %s is not a number", spec, key)
+			}
+		}
+	}
+
+	rng := rand.New(&lockedSource{src: rand.NewSource(seed)})
+	base := distribution{rng: rng, spec: spec}
+
+	var dist Distribution
+	switch name {
+	case "constant":
+		dist = &constantDistribution{distribution: base, value: params.get("value", mean)}
+	case "normal":
+		dist = &normalDistribution{distribution: base, mean: params.get("mean", mean), stddev: params.get("stddev", 10)}
+	case "exponential":
+		dist = &exponentialDistribution{distribution: base, mean: params.get("mean", mean)}
+	case "lognormal":
+		sigma := params.get("sigma", 1)
+		dist = &logNormalDistribution{distribution: base, mu: math.Log(params.get("mean", mean)) - sigma*sigma/2, sigma: sigma}
+	case "pareto":
+		alpha := params.get("alpha", 3)
+		if alpha <= 1 {
+			return nil, fmt.Errorf("%s: alpha must be greater than 1", spec)
+		}
+		dist = &paretoDistribution{distribution: base, scale: params.get("mean", mean) * (alpha - 1) / alpha, alpha: alpha}
+	case "bimodal":
+		dist = &bimodalDistribution{
+			distribution: base,
+			low:          params.get("low", mean/2),
+			high:         params.get("high", mean*3/2),
+			p:            params.get("p", 0.5),
+			stddev:       params.get("stddev", mean/10),
+		}
+	case "empirical":
+		file, ok := params["file"]
+		if !ok {
+			return nil, fmt.Errorf("%s: missing file", spec)
+		}
+		values, weights, err := loadHistogram(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", spec, err)
+		}
+		dist = &empiricalDistribution{distribution: base, values: values, cumulative: weights}
+	default:
+		return nil, fmt.Errorf("unknown distribution %s", name)
+	}
+	return dist, nil
+}
+
+type distributionParams map[string]string
+
+func (p distributionParams) get(key string, fallback float64) float64 {
+	if value, err := strconv.ParseFloat(p[key], 64); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func parseDistributionSpec(spec string) (string, distributionParams, error) {
+	params := distributionParams{}
+	parts := strings.SplitN(spec, ":", 2)
+	name := strings.ToLower(strings.TrimSpace(parts[0]))
+	if len(parts) < 2 {
+		return name, params, nil
+	}
+
+	for _, param := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return "", nil, fmt.Errorf("%s: parameter %s is not key=value", spec, param)
+		}
+		params[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return name, params, nil
+}
+
+// loadHistogram reads "value,weight" lines, skipping blank lines and # comments,
+// and returns the values with their cumulative weights
+func loadHistogram(filename string) ([]float64, []float64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var values, cumulative []float64
+	total := 0.0
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("%s:%d: expected value,weight", filename, line)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil || weight < 0 {
+			return nil, nil, fmt.Errorf("%s:%d: invalid weight %s", filename, line, fields[1])
+		}
+		total += weight
+		values = append(values, value)
+		cumulative = append(cumulative, total)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if total <= 0 {
+		return nil, nil, fmt.Errorf("%s: empty histogram", filename)
+	}
+	return values, cumulative, nil
+}
+
+// lockedSource makes a rand.Source safe for concurrent requests
+type lockedSource struct {
+	mux sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.src.Seed(seed)
+}
+
+type distribution struct {
+	rng  *rand.Rand
+	spec string
+}
+
+func (d *distribution) String() string {
+	return d.spec
+}
+
+type constantDistribution struct {
+	distribution
+	value float64
+}
+
+func (d *constantDistribution) Sample() float64 {
+	return math.Max(0, d.value)
+}
+
+type normalDistribution struct {
+	distribution
+	mean   float64
+	stddev float64
+}
+
+func (d *normalDistribution) Sample() float64 {
+	return math.Max(0, d.rng.NormFloat64()*d.stddev+d.mean)
+}
+
+type exponentialDistribution struct {
+	distribution
+	mean float64
+}
+
+func (d *exponentialDistribution) Sample() float64 {
+	return math.Max(0, d.rng.ExpFloat64()*d.mean)
+}
+
+type logNormalDistribution struct {
+	distribution
+	mu    float64
+	sigma float64
+}
+
+func (d *logNormalDistribution) Sample() float64 {
+	return math.Exp(d.rng.NormFloat64()*d.sigma + d.mu)
+}
+
+type paretoDistribution struct {
+	distribution
+	scale float64
+	alpha float64
+}
+
+func (d *paretoDistribution) Sample() float64 {
+	return math.Max(0, d.scale/math.Pow(1-d.rng.Float64(), 1/d.alpha))
+}
+
+type bimodalDistribution struct {
+	distribution
+	low    float64
+	high   float64
+	p      float64
+	stddev float64
+}
+
+func (d *bimodalDistribution) Sample() float64 {
+	mean := d.high
+	if d.rng.Float64() < d.p {
+		mean = d.low
+	}
+	return math.Max(0, d.rng.NormFloat64()*d.stddev+mean)
+}
+
+type empiricalDistribution struct {
+	distribution
+	values     []float64
+	cumulative []float64
+}
+
+func (d *empiricalDistribution) Sample() float64 {
+	draw := d.rng.Float64() * d.cumulative[len(d.cumulative)-1]
+	i := sort.SearchFloat64s(d.cumulative, draw)
+	if i >= len(d.values) {
+		i = len(d.values) - 1
+	}
+	return math.Max(0, d.values[i])
+}
+
+// endpointSpecFlag collects specs given per endpoint on the command line, such as
+// the distributions of --msg-size and --msg-time and the samplers of --sampling.
+// A plain spec is the default of the service; /endpoint=spec overrides it for
+// one endpoint, e.g. /all=exponential or /0=pareto:alpha=2.
+type endpointSpecFlag map[string]string
+
+func (f endpointSpecFlag) String() string {
+	specs := make([]string, 0, len(f))
+	for endpoint, spec := range f {
+		if endpoint == "" {
+			specs = append(specs, spec)
+		} else {
+			specs = append(specs, "/"+endpoint+"="+spec)
+		}
+	}
+	sort.Strings(specs)
+	return strings.Join(specs, " ")
+}
+
+func (f endpointSpecFlag) Set(value string) error {
+	if strings.HasPrefix(value, "/") {
+		kv := strings.SplitN(value[1:], "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected /endpoint=spec")
+		}
+		f[kv[0]] = kv[1]
+		return nil
+	}
+	f[""] = value
+	return nil
+}
+
+// Distributions holds the distribution of the service and of each endpoint overriding it
+type Distributions struct {
+	byEndpoint map[string]Distribution
+}
+
+// newDistributions builds the distributions of specs, which must include the
+// service default under "". Each distribution gets its own seed derived from seed.
+func newDistributions(specs endpointSpecFlag, mean float64, seed int64) (*Distributions, error) {
+	endpoints := make([]string, 0, len(specs))
+	for endpoint := range specs {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	seeds := rand.New(rand.NewSource(seed))
+	dists := &Distributions{byEndpoint: make(map[string]Distribution, len(specs))}
+	for _, endpoint := range endpoints {
+		dist, err := newDistribution(specs[endpoint], mean, seeds.Int63())
+		if err != nil {
+			return nil, err
+		}
+		dists.byEndpoint[endpoint] = dist
+	}
+	return dists, nil
+}
+
+// Sample draws from the distribution of endpoint, or from the service default
+func (d *Distributions) Sample(endpoint string) float64 {
+	if dist, ok := d.byEndpoint[endpoint]; ok {
+		return dist.Sample()
+	}
+	return d.byEndpoint[""].Sample()
+}
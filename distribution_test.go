@@ -0,0 +1,189 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewDistribution(t *testing.T) {
+	const samples = 20000
+	tests := []struct {
+		spec string
+		mean float64
+		// want is the expected mean of the samples, within tolerance
+		want      float64
+		tolerance float64
+		err       string
+	}{
+		{spec: "constant", mean: 10, want: 10},
+		{spec: "constant:value=3", mean: 10, want: 3},
+		{spec: "normal:stddev=1", mean: 10, want: 10, tolerance: 0.1},
+		{spec: "normal:mean=20,stddev=1", mean: 10, want: 20, tolerance: 0.1},
+		{spec: "exponential", mean: 10, want: 10, tolerance: 0.5},
+		{spec: "lognormal:sigma=0.5", mean: 10, want: 10, tolerance: 0.5},
+		{spec: "pareto:alpha=3", mean: 10, want: 10, tolerance: 1},
+		{spec: "bimodal:low=5,high=15,stddev=0.1", mean: 10, want: 10, tolerance: 0.5},
+		{spec: "bimodal:low=5,high=15,p=1,stddev=0.1", mean: 10, want: 5, tolerance: 0.1},
+		{spec: "uniform", mean: 10, err: "unknown distribution uniform"},
+		{spec: "pareto:alpha=1", mean: 10, err: "alpha must be greater than 1"},
+		{spec: "normal:stddev=wide", mean: 10, err: "stddev is not a number"},
+		{spec: "normal:stddev", mean: 10, err: "is not key=value"},
+		{spec: "empirical", mean: 10, err: "missing file"},
+		{spec: "empirical:file=/nonexistent/histogram.csv", mean: 10, err: "no such file"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			dist, err := newDistribution(test.spec, test.mean, 1)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("newDistribution(%s) error = %v, want %q", test.spec, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newDistribution(%s) error = %v", test.spec, err)
+			}
+			if dist.String() != test.spec {
+				t.Errorf("String() = %s, want %s", dist.String(), test.spec)
+			}
+
+			sum := 0.0
+			for i := 0; i < samples; i++ {
+				sample := dist.Sample()
+				if sample < 0 {
+					t.Fatalf("Sample() = %g, want a non-negative value", sample)
+				}
+				sum += sample
+			}
+			if mean := sum / samples; math.Abs(mean-test.want) > test.tolerance {
+				t.Errorf("mean of the samples = %g, want %g ± %g", mean, test.want, test.tolerance)
+			}
+		})
+	}
+}
+
+func TestDistributionSeed(t *testing.T) {
+	first, _ := newDistribution("exponential", 10, 42)
+	second, _ := newDistribution("exponential", 10, 42)
+	for i := 0; i < 100; i++ {
+		if a, b := first.Sample(), second.Sample(); a != b {
+			t.Fatalf("sample %d = %g and %g with the same seed", i, a, b)
+		}
+	}
+}
+
+func TestLoadHistogram(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		values     []float64
+		cumulative []float64
+		err        string
+	}{
+		{
+			name:       "weights accumulate",
+			content:    "1,1\n5,2\n10,1\n",
+			values:     []float64{1, 5, 10},
+			cumulative: []float64{1, 3, 4},
+		},
+		{
+			name:       "comments and blank lines are skipped",
+			content:    "# value,weight\n\n 2 , 0.5 \n4,0.5\n",
+			values:     []float64{2, 4},
+			cumulative: []float64{0.5, 1},
+		},
+		{name: "missing weight", content: "1,1\n5\n", err: "histogram.csv:2: expected value,weight"},
+		{name: "value not a number", content: "ten,1\n", err: "histogram.csv:1:"},
+		{name: "negative weight", content: "1,-1\n", err: "invalid weight"},
+		{name: "all weights zero", content: "1,0\n2,0\n", err: "empty histogram"},
+		{name: "empty file", content: "", err: "empty histogram"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "histogram.csv")
+			if err := os.WriteFile(filename, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			values, cumulative, err := loadHistogram(filename)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("loadHistogram() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadHistogram() error = %v", err)
+			}
+			if !reflect.DeepEqual(values, test.values) || !reflect.DeepEqual(cumulative, test.cumulative) {
+				t.Errorf("loadHistogram() = %v, %v, want %v, %v", values, cumulative, test.values, test.cumulative)
+			}
+		})
+	}
+}
+
+func TestEmpiricalDistribution(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "histogram.csv")
+	// 1 has no weight, 5 is drawn three times as often as 9
+	if err := os.WriteFile(filename, []byte("1,0\n5,3\n9,1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dist, err := newDistribution("empirical:file="+filename, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[float64]int{}
+	for i := 0; i < 10000; i++ {
+		counts[dist.Sample()]++
+	}
+	if counts[1] != 0 || len(counts) != 2 {
+		t.Fatalf("samples = %v, want only 5 and 9", counts)
+	}
+	if ratio := float64(counts[5]) / float64(counts[9]); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("5 drawn %g times as often as 9, want 3", ratio)
+	}
+}
+
+func TestDistributions(t *testing.T) {
+	specs := endpointSpecFlag{}
+	for _, value := range []string{"constant", "/all=constant:value=3", "/0=constant:value=7"} {
+		if err := specs.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := specs.Set("/all"); err == nil {
+		t.Error("Set(/all) returned no error")
+	}
+	if got, want := specs.String(), "/0=constant:value=7 /all=constant:value=3 constant"; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+
+	dists, err := newDistributions(specs, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		endpoint string
+		want     float64
+	}{
+		{endpoint: "all", want: 3},
+		{endpoint: "0", want: 7},
+		{endpoint: "random", want: 10},
+	}
+	for _, test := range tests {
+		if sample := dists.Sample(test.endpoint); sample != test.want {
+			t.Errorf("Sample(%s) = %g, want %g", test.endpoint, sample, test.want)
+		}
+	}
+
+	if _, err := newDistributions(endpointSpecFlag{"": "constant", "all": "uniform"}, 10, 1); err == nil {
+		t.Error("newDistributions() with an unknown distribution returned no error")
+	}
+}
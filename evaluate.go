@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	evaluateGrid   = "grid"
+	evaluateRandom = "random"
+)
+
+var evaluateSpec string
+
+// Prediction is what the model gives for a set of parameters. Values the model
+// leaves undefined (NaN) are reported as 0
+type Prediction struct {
+	Parameters
+	Load              float64 `json:"load"`
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	LatencySeconds    float64 `json:"latencySeconds"`
+	MemoryUnits       uint    `json:"memoryUnits"`
+	MemoryBytes       uint64  `json:"memoryBytes"`
+	// Objective is the requests per second per MiB of memory held, higher is better
+	Objective float64 `json:"objective"`
+}
+
+// predict evaluates the model at params without applying them
+func predict(params Parameters) Prediction {
+	units := params.Memory()
+	prediction := Prediction{
+		Parameters:        params,
+		Load:              definedOrZero(params.Load()),
+		RequestsPerSecond: definedOrZero(params.RequestsPerSecond()),
+		LatencySeconds:    params.Latency().Seconds(),
+		MemoryUnits:       units,
+		MemoryBytes:       uint64(units) * uint64(epsilon) * 1024 * 1024,
+	}
+	prediction.Objective = prediction.RequestsPerSecond / math.Max(1, float64(units)*float64(epsilon))
+	return prediction
+}
+
+func definedOrZero(value float64) float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0
+	}
+	return value
+}
+
+// evaluate predicts the model at the points of the search space given by spec:
+//
+//	grid:points=3        every combination of the integer values, the categorical values
+//	                     and points evenly spaced values of every real range
+//	random:samples=1000  points drawn at random from the ranges and values, seeded from --random-seed
+//
+// Every prediction is written to w as a CSV line and the best one is returned
+func evaluate(spec string, w io.Writer) (Prediction, int, error) {
+	name, params, err := parseDistributionSpec(spec)
+	if err != nil {
+		return Prediction{}, 0, err
+	}
+
+	out := csv.NewWriter(w)
+	header := []string{}
+	for _, definition := range parameterSpaces {
+		header = append(header, definition.Name)
+	}
+	header = append(header, "load", "requests_per_second", "latency_seconds", "memory_bytes", "objective")
+	out.Write(header)
+
+	var best Prediction
+	count := 0
+	record := func(point []float64) {
+		prediction := predict(parametersAt(point))
+		if count == 0 || prediction.Objective > best.Objective {
+			best = prediction
+		}
+		count++
+
+		line := make([]string, 0, len(header))
+		for _, value := range point {
+			line = append(line, strconv.FormatFloat(value, 'g', -1, 64))
+		}
+		for _, value := range []float64{prediction.Load, prediction.RequestsPerSecond, prediction.LatencySeconds, float64(prediction.MemoryBytes), prediction.Objective} {
+			line = append(line, strconv.FormatFloat(value, 'g', -1, 64))
+		}
+		out.Write(line)
+	}
+
+	switch name {
+	case evaluateGrid:
+		points := int(params.get("points", 3))
+		if points < 1 {
+			return Prediction{}, 0, fmt.Errorf("%s: points must be at least 1", spec)
+		}
+		axes := make([][]float64, len(parameterSpaces))
+		for i, definition := range parameterSpaces {
+			axes[i] = gridValues(definition.ParameterSpace, points)
+		}
+		walkGrid(axes, make([]float64, 0, len(axes)), record)
+	case evaluateRandom:
+		samples := int(params.get("samples", 1000))
+		if samples < 1 {
+			return Prediction{}, 0, fmt.Errorf("%s: samples must be at least 1", spec)
+		}
+		random := rand.New(rand.NewSource(randomSeed))
+		for i := 0; i < samples; i++ {
+			point := make([]float64, len(parameterSpaces))
+			for j, definition := range parameterSpaces {
+				point[j] = randomValue(definition.ParameterSpace, random)
+			}
+			record(point)
+		}
+	default:
+		return Prediction{}, 0, fmt.Errorf("unknown evaluation %s, expected %s or %s", name, evaluateGrid, evaluateRandom)
+	}
+
+	out.Flush()
+	return best, count, out.Error()
+}
+
+// parametersAt returns the parameters of a point, in the order of parameterSpaces
+func parametersAt(point []float64) Parameters {
+	var params Parameters
+	for i, definition := range parameterSpaces {
+		definition.set(&params, point[i])
+	}
+	return params
+}
+
+// gridValues returns the values of a parameter on the grid: every step of a
+// discrete range, points values of a continuous one, and the categorical values
+func gridValues(parameter ParameterSpace, points int) []float64 {
+	values := []float64{}
+	for _, r := range parameter.Ranges {
+		if r.Step > 0 {
+			for value := r.Lower; value <= r.Upper; value += r.Step {
+				values = append(values, value)
+			}
+			continue
+		}
+		if points == 1 {
+			values = append(values, (r.Lower+r.Upper)/2)
+			continue
+		}
+		for i := 0; i < points; i++ {
+			values = append(values, r.Lower+(r.Upper-r.Lower)*float64(i)/float64(points-1))
+		}
+	}
+	return append(values, parameter.Values...)
+}
+
+// randomValue draws a value of a parameter: a range, or the categorical values,
+// is picked at random, then a value within it
+func randomValue(parameter ParameterSpace, random *rand.Rand) float64 {
+	choices := len(parameter.Ranges)
+	if len(parameter.Values) > 0 {
+		choices++
+	}
+	choice := random.Intn(choices)
+	if choice == len(parameter.Ranges) {
+		return parameter.Values[random.Intn(len(parameter.Values))]
+	}
+	r := parameter.Ranges[choice]
+	if r.Step > 0 {
+		return r.Lower + r.Step*float64(random.Intn(int((r.Upper-r.Lower)/r.Step)+1))
+	}
+	return r.Lower + (r.Upper-r.Lower)*random.Float64()
+}
+
+// walkGrid calls record with every combination of the values of axes
+func walkGrid(axes [][]float64, point []float64, record func(point []float64)) {
+	if len(point) == len(axes) {
+		record(point)
+		return
+	}
+	for _, value := range axes[len(point)] {
+		walkGrid(axes, append(point, value), record)
+	}
+}
+
+// registerAdminPredict adds the predictions of the model to r:
+//
+//	POST   /admin/predict                  predicted metrics of the parameters in the body, those left out keep their value, without applying them
+func registerAdminPredict(r *mux.Router, tuner *Tuner) {
+	r.Methods("POST").Path("/admin/predict").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := tuner.Parameters()
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, predict(params))
+	})
+}
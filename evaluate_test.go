@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGridValues(t *testing.T) {
+	tests := []struct {
+		name      string
+		parameter ParameterSpace
+		points    int
+		values    []float64
+	}{
+		{
+			name:      "discrete range",
+			parameter: ParameterSpace{Ranges: []ParameterRange{{Lower: -3, Upper: 3, Step: 1}}},
+			points:    2,
+			values:    []float64{-3, -2, -1, 0, 1, 2, 3},
+		},
+		{
+			name:      "continuous range",
+			parameter: ParameterSpace{Ranges: []ParameterRange{{Lower: -4, Upper: 4}}},
+			points:    5,
+			values:    []float64{-4, -2, 0, 2, 4},
+		},
+		{
+			name:      "middle of the range",
+			parameter: ParameterSpace{Ranges: []ParameterRange{{Lower: -4, Upper: 2}}},
+			points:    1,
+			values:    []float64{-1},
+		},
+		{
+			name:      "disjoint ranges",
+			parameter: ParameterSpace{Ranges: []ParameterRange{{Lower: -10, Upper: -5}, {Lower: 5, Upper: 10}}},
+			points:    2,
+			values:    []float64{-10, -5, 5, 10},
+		},
+		{
+			name:      "categorical values",
+			parameter: ParameterSpace{Ranges: []ParameterRange{{Lower: 0, Upper: 1}}, Values: []float64{10, 100}},
+			points:    1,
+			values:    []float64{0.5, 10, 100},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if values := gridValues(test.parameter, test.points); !reflect.DeepEqual(values, test.values) {
+				t.Errorf("gridValues() = %v, want %v", values, test.values)
+			}
+		})
+	}
+}
+
+func TestRandomValue(t *testing.T) {
+	parameter := ParameterSpace{
+		Ranges: []ParameterRange{{Lower: -10, Upper: -5}, {Lower: 1, Upper: 3, Step: 1}},
+		Values: []float64{100},
+	}
+	random := rand.New(rand.NewSource(1))
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		value := randomValue(parameter, random)
+		switch {
+		case value >= -10 && value <= -5:
+			seen["continuous"] = true
+		case value == 1 || value == 2 || value == 3:
+			seen["discrete"] = true
+		case value == 100:
+			seen["categorical"] = true
+		default:
+			t.Fatalf("randomValue() = %g, out of the domain", value)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("randomValue() drew from %v, want every range and the values", seen)
+	}
+}
+
+func TestParametersAt(t *testing.T) {
+	params := Parameters{X: 1, Y: -2, A: 0.5, B: 100, C: -3, D: 0.01, E: 2, F: 6, G: -1, H: 12.5}
+
+	point := make([]float64, 0, len(parameterSpaces))
+	for _, definition := range parameterSpaces {
+		point = append(point, definition.value(params))
+	}
+	if got := parametersAt(point); got != params {
+		t.Errorf("parametersAt(%v) = %+v, want %+v", point, got, params)
+	}
+}
+
+func TestPredict(t *testing.T) {
+	params := Parameters{X: 1, Y: 1, A: 1, B: 1, C: 1, D: 0.01, E: 1, F: 6, G: 1, H: 1}
+	prediction := predict(params)
+
+	if prediction.Parameters != params {
+		t.Errorf("Parameters = %+v, want %+v", prediction.Parameters, params)
+	}
+	if prediction.MemoryUnits != params.Memory() || prediction.MemoryBytes != uint64(prediction.MemoryUnits)*uint64(epsilon)*1024*1024 {
+		t.Errorf("memory = %d units, %d bytes, want %d units", prediction.MemoryUnits, prediction.MemoryBytes, params.Memory())
+	}
+	want := prediction.RequestsPerSecond / math.Max(1, float64(prediction.MemoryUnits)*float64(epsilon))
+	if prediction.Objective != want {
+		t.Errorf("Objective = %g, want %g", prediction.Objective, want)
+	}
+	for name, value := range map[string]float64{"load": prediction.Load, "requestsPerSecond": prediction.RequestsPerSecond, "objective": prediction.Objective} {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			t.Errorf("%s = %g, want a defined value", name, value)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	// the grid with one point per continuous range
+	gridSize := 1
+	for _, definition := range parameterSpaces {
+		gridSize *= len(gridValues(definition.ParameterSpace, 1))
+	}
+
+	tests := []struct {
+		spec  string
+		count int
+		err   string
+	}{
+		{spec: "grid:points=1", count: gridSize},
+		{spec: "random:samples=50", count: 50},
+		{spec: "grid:points=0", err: "points must be at least 1"},
+		{spec: "random:samples=0", err: "samples must be at least 1"},
+		{spec: "annealing", err: "unknown evaluation annealing"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			best, count, err := evaluate(test.spec, out)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("evaluate(%s) error = %v, want %q", test.spec, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("evaluate(%s) error = %v", test.spec, err)
+			}
+			if count != test.count {
+				t.Errorf("evaluate(%s) count = %d, want %d", test.spec, count, test.count)
+			}
+
+			lines, err := csv.NewReader(out).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lines) != count+1 {
+				t.Fatalf("%d CSV lines, want a header and %d predictions", len(lines), count)
+			}
+			header := lines[0]
+			want := len(parameterSpaces) + 5
+			if len(header) != want || header[0] != parameterSpaces[0].Name || header[len(header)-1] != "objective" {
+				t.Fatalf("header = %v, want the %d parameters, the metrics and the objective", header, len(parameterSpaces))
+			}
+
+			// the best prediction has the highest objective of the lines
+			highest := math.Inf(-1)
+			for _, line := range lines[1:] {
+				if len(line) != want {
+					t.Fatalf("line %v has %d fields, want %d", line, len(line), want)
+				}
+				objective, err := strconv.ParseFloat(line[len(line)-1], 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				highest = math.Max(highest, objective)
+			}
+			if best.Objective != highest {
+				t.Errorf("best objective = %g, want %g", best.Objective, highest)
+			}
+		})
+	}
+}
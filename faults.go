@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+const (
+	faultError    = "error"
+	faultDelay    = "delay"
+	faultReset    = "reset"
+	faultTruncate = "truncate"
+	faultHang     = "hang"
+
+	// callerHeader names the service sending a request, so faults can be scoped by caller
+	callerHeader = "ST-Caller"
+)
+
+// Fault is a failure injected into a percentage of the requests it matches.
+// The scope fields left empty match every request.
+type Fault struct {
+	// Type is error, delay, reset, truncate or hang
+	Type string `json:"type" yaml:"type"`
+	// Percent is the percentage of the matching requests that get the fault, 0 means all of them
+	Percent float64 `json:"percent,omitempty" yaml:"percent,omitempty"`
+	// Service is the node the fault applies to, for faults shared in a topology file
+	Service string `json:"service,omitempty" yaml:"service,omitempty"`
+	// Endpoint is the endpoint or path id the fault applies to
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	// Caller is the upstream service the fault applies to
+	Caller string `json:"caller,omitempty" yaml:"caller,omitempty"`
+	// Header is Name or Name=value, the fault applies to requests carrying it
+	Header string `json:"header,omitempty" yaml:"header,omitempty"`
+	// Code is the status answered by an error fault
+	Code int `json:"code,omitempty" yaml:"code,omitempty"`
+	// Delay is the latency added by a delay fault, or how long a hang fault holds
+	// the request before dropping it (until the client gives up if empty)
+	Delay string `json:"delay,omitempty" yaml:"delay,omitempty"`
+	// Distribution draws the delay from a distribution around Delay, see newDistribution
+	Distribution string `json:"distribution,omitempty" yaml:"distribution,omitempty"`
+
+	delay time.Duration
+	dist  Distribution
+}
+
+// validate checks f and prepares its delay
+func (f *Fault) validate() error {
+	switch f.Type {
+	case faultError:
+		if f.Code == 0 {
+			f.Code = http.StatusServiceUnavailable
+		}
+		if f.Code < 100 || f.Code > 599 {
+			return fmt.Errorf("fault %s: code %d is not an HTTP status", f.Type, f.Code)
+		}
+	case faultDelay:
+		if f.Delay == "" {
+			return fmt.Errorf("fault %s: missing delay", f.Type)
+		}
+	case faultReset, faultTruncate, faultHang:
+	default:
+		return fmt.Errorf("unknown fault %s, must be %s, %s, %s, %s or %s",
+			f.Type, faultError, faultDelay, faultReset, faultTruncate, faultHang)
+	}
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("fault %s: percent must be a percentage", f.Type)
+	}
+
+	f.delay, f.dist = 0, nil
+	if f.Delay != "" {
+		delay, err := time.ParseDuration(f.Delay)
+		if err != nil || delay < 0 {
+			return fmt.Errorf("fault %s: invalid delay %s", f.Type, f.Delay)
+		}
+		f.delay = delay
+	}
+	if f.Distribution != "" {
+		dist, err := newDistribution(f.Distribution, float64(f.delay)/float64(time.Millisecond), rand.Int63())
+		if err != nil {
+			return fmt.Errorf("fault %s: %v", f.Type, err)
+		}
+		f.dist = dist
+	}
+	return nil
+}
+
+// matches reports whether the request r to endpoint is in the scope of f
+// and, if so, whether it falls in its percentage
+func (f *Fault) matches(endpoint string, r *http.Request) bool {
+	if f.Service != "" && f.Service != globalName {
+		return false
+	}
+	if f.Endpoint != "" && f.Endpoint != endpoint {
+		return false
+	}
+	if f.Caller != "" && f.Caller != r.Header.Get(callerHeader) {
+		return false
+	}
+	if f.Header != "" {
+		kv := strings.SplitN(f.Header, "=", 2)
+		values, ok := r.Header[http.CanonicalHeaderKey(kv[0])]
+		if !ok || (len(kv) == 2 && !contains(values, kv[1])) {
+			return false
+		}
+	}
+	return f.Percent == 0 || rand.Float64()*100 < f.Percent
+}
+
+// sampleDelay returns the latency added by f
+func (f *Fault) sampleDelay() time.Duration {
+	if f.dist == nil {
+		return f.delay
+	}
+	delay := time.Duration(f.dist.Sample() * float64(time.Millisecond))
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultInjector holds the faults set on the command line or through the admin
+// API; the faults of the served topology are applied along with them
+type FaultInjector struct {
+	mux    sync.RWMutex
+	faults []Fault
+	paths  *PathRoutes
+}
+
+var (
+	faultSpecs    faultFlag
+	faultInjector *FaultInjector
+)
+
+func NewFaultInjector(faults []Fault, paths *PathRoutes) *FaultInjector {
+	return &FaultInjector{faults: faults, paths: paths}
+}
+
+// List returns the faults set on the command line or through the admin API
+func (i *FaultInjector) List() []Fault {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return append([]Fault{}, i.faults...)
+}
+
+// Set validates faults and replaces the current ones with them
+func (i *FaultInjector) Set(faults []Fault) error {
+	for j := range faults {
+		if err := faults[j].validate(); err != nil {
+			return err
+		}
+	}
+	i.mux.Lock()
+	i.faults = faults
+	i.mux.Unlock()
+	return nil
+}
+
+// Add validates fault and appends it to the current faults
+func (i *FaultInjector) Add(fault Fault) error {
+	if err := fault.validate(); err != nil {
+		return err
+	}
+	i.mux.Lock()
+	i.faults = append(i.faults, fault)
+	i.mux.Unlock()
+	return nil
+}
+
+// active returns every fault to consider, the topology ones last
+func (i *FaultInjector) active() []Fault {
+	faults := i.List()
+	if i.paths != nil {
+		faults = append(faults, i.paths.Topology().Faults...)
+	}
+	return faults
+}
+
+/**
+* injectFault applies the faults matching a request: delays are added, then the
+* first matching error, reset, truncate or hang fault takes the request over.
+* Every fault is tagged on span.
+* @param w the writer of the response
+* @param r the request
+* @param endpoint the endpoint or path id of the request
+* @param span the server span of the request
+* @return http.ResponseWriter the writer the handler must answer through
+* @return int the status answered, 0 if the connection was dropped
+* @return bool true if the fault answered the request and the handler must stop
+ */
+func injectFault(w http.ResponseWriter, r *http.Request, endpoint string, span opentracing.Span) (http.ResponseWriter, int, bool) {
+	if faultInjector == nil {
+		return w, 0, false
+	}
+
+	for _, fault := range faultInjector.active() {
+		if !fault.matches(endpoint, r) {
+			continue
+		}
+		faultsInjectedTotal.WithLabelValues(endpoint, fault.Type).Inc()
+
+		switch fault.Type {
+		case faultDelay:
+			delay := fault.sampleDelay()
+			span.SetTag("fault.delay", delay.String())
+			span.LogKV("event", "fault", "type", fault.Type, "delay", delay.String())
+			sleepContext(r.Context(), delay)
+			continue
+		case faultError:
+			span.SetTag("fault.error", fault.Code)
+			span.LogKV("event", "fault", "type", fault.Type, "code", fault.Code)
+			w.WriteHeader(fault.Code)
+			w.Write([]byte{0})
+			return w, fault.Code, true
+		case faultTruncate:
+			span.SetTag("fault.truncate", true)
+			span.LogKV("event", "fault", "type", fault.Type)
+			ext.Error.Set(span, true)
+			return &truncatingWriter{ResponseWriter: w, status: http.StatusOK}, 0, false
+		case faultReset:
+			span.SetTag("fault.reset", true)
+			span.LogKV("event", "fault", "type", fault.Type)
+			ext.Error.Set(span, true)
+			dropConnection(w, true)
+			return w, 0, true
+		case faultHang:
+			span.SetTag("fault.hang", true)
+			span.LogKV("event", "fault", "type", fault.Type)
+			ext.Error.Set(span, true)
+			if fault.delay > 0 {
+				if sleepContext(r.Context(), fault.sampleDelay()) {
+					dropConnection(w, false)
+				}
+			} else {
+				<-r.Context().Done()
+			}
+			return w, 0, true
+		}
+	}
+	return w, 0, false
+}
+
+// dropConnection closes the connection of w without answering; reset closes it
+// with a TCP RST instead of a FIN
+func dropConnection(w http.ResponseWriter, reset bool) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("cannot drop the connection: %v\n", err)
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok && reset {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// truncatingWriter announces the full length of the body but sends half of it
+// before dropping the connection
+type truncatingWriter struct {
+	http.ResponseWriter
+	status int
+	done   bool
+}
+
+func (t *truncatingWriter) WriteHeader(status int) {
+	t.status = status
+}
+
+func (t *truncatingWriter) Write(body []byte) (int, error) {
+	if t.done {
+		return len(body), nil
+	}
+	t.done = true
+	t.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	t.ResponseWriter.WriteHeader(t.status)
+	t.ResponseWriter.Write(body[:len(body)/2])
+	dropConnection(t.ResponseWriter, false)
+	return len(body), nil
+}
+
+func (t *truncatingWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// faultFlag collects the faults given on the command line as
+// type[:key=value,...] with the keys percent, endpoint, caller, header, code,
+// delay and distribution, e.g. error:code=500,percent=10,endpoint=0 or
+// delay:delay=100ms,distribution=exponential,caller=svc-0.
+// A distribution takes at most one parameter here, as commas separate the keys.
+type faultFlag []Fault
+
+func (f *faultFlag) String() string {
+	faults := make([]string, 0, len(*f))
+	for _, fault := range *f {
+		faults = append(faults, fault.Type)
+	}
+	return strings.Join(faults, " ")
+}
+
+func (f *faultFlag) Set(value string) error {
+	fault := Fault{}
+	kv := strings.SplitN(value, ":", 2)
+	fault.Type = strings.TrimSpace(kv[0])
+	if len(kv) == 2 && strings.TrimSpace(kv[1]) != "" {
+		for _, param := range strings.Split(kv[1], ",") {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("parameter %s is not key=value", param)
+			}
+			key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+			var err error
+			switch key {
+			case "percent":
+				fault.Percent, err = strconv.ParseFloat(val, 64)
+			case "endpoint":
+				fault.Endpoint = val
+			case "caller":
+				fault.Caller = val
+			case "header":
+				fault.Header = val
+			case "code":
+				fault.Code, err = strconv.Atoi(val)
+			case "delay":
+				fault.Delay = val
+			case "distribution":
+				fault.Distribution = val
+			default:
+				return fmt.Errorf("unknown fault parameter %s", key)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	if err := fault.validate(); err != nil {
+		return err
+	}
+	*f = append(*f, fault)
+	return nil
+}
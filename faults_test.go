@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestFaultFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		fault Fault
+		err   string
+	}{
+		{value: "error", fault: Fault{Type: faultError, Code: http.StatusServiceUnavailable}},
+		{
+			value: "error:code=500,percent=10,endpoint=0",
+			fault: Fault{Type: faultError, Code: 500, Percent: 10, Endpoint: "0"},
+		},
+		{
+			value: "delay:delay=100ms,caller=svc-0,header=X-Test=1",
+			fault: Fault{Type: faultDelay, Delay: "100ms", Caller: "svc-0", Header: "X-Test=1", delay: 100 * time.Millisecond},
+		},
+		{value: "reset:", fault: Fault{Type: faultReset}},
+		{value: "hang:delay=1s", fault: Fault{Type: faultHang, Delay: "1s", delay: time.Second}},
+		{value: "abort", err: "unknown fault abort"},
+		{value: "error:code=700", err: "is not an HTTP status"},
+		{value: "error:code=teapot", err: "code"},
+		{value: "delay", err: "missing delay"},
+		{value: "delay:delay=soon", err: "invalid delay soon"},
+		{value: "delay:delay=-1s", err: "invalid delay -1s"},
+		{value: "reset:percent=150", err: "percent must be a percentage"},
+		{value: "reset:percent", err: "is not key=value"},
+		{value: "reset:service=svc-1", err: "unknown fault parameter service"},
+		{value: "delay:delay=10ms,distribution=uniform", err: "unknown distribution uniform"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			faults := faultFlag{}
+			err := faults.Set(test.value)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Set(%s) error = %v, want %q", test.value, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Set(%s) error = %v", test.value, err)
+			}
+			if len(faults) != 1 || faults[0] != test.fault {
+				t.Errorf("Set(%s) = %+v, want %+v", test.value, faults, test.fault)
+			}
+		})
+	}
+}
+
+func TestFaultMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		fault    Fault
+		endpoint string
+		headers  map[string]string
+		matches  bool
+	}{
+		{name: "no scope", fault: Fault{}, endpoint: "0", matches: true},
+		{name: "this service", fault: Fault{Service: "svc-1"}, endpoint: "0", matches: true},
+		{name: "other service", fault: Fault{Service: "svc-2"}, endpoint: "0", matches: false},
+		{name: "endpoint", fault: Fault{Endpoint: "0"}, endpoint: "0", matches: true},
+		{name: "other endpoint", fault: Fault{Endpoint: "0"}, endpoint: "all", matches: false},
+		{name: "caller", fault: Fault{Caller: "svc-0"}, headers: map[string]string{callerHeader: "svc-0"}, matches: true},
+		{name: "other caller", fault: Fault{Caller: "svc-0"}, headers: map[string]string{callerHeader: "svc-3"}, matches: false},
+		{name: "no caller", fault: Fault{Caller: "svc-0"}, matches: false},
+		{name: "header present", fault: Fault{Header: "X-Test"}, headers: map[string]string{"X-Test": "anything"}, matches: true},
+		{name: "header absent", fault: Fault{Header: "X-Test"}, matches: false},
+		{name: "header value", fault: Fault{Header: "x-test=1"}, headers: map[string]string{"X-Test": "1"}, matches: true},
+		{name: "other header value", fault: Fault{Header: "X-Test=1"}, headers: map[string]string{"X-Test": "2"}, matches: false},
+		{name: "every scope", fault: Fault{Endpoint: "0", Caller: "svc-0", Header: "X-Test"},
+			endpoint: "0", headers: map[string]string{callerHeader: "svc-0", "X-Test": "1"}, matches: true},
+	}
+
+	defer func(name string) { globalName = name }(globalName)
+	globalName = "svc-1"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/"+test.endpoint, nil)
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			if matches := test.fault.matches(test.endpoint, r); matches != test.matches {
+				t.Errorf("matches(%s) = %v, want %v", test.endpoint, matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestFaultPercent(t *testing.T) {
+	fault := Fault{Percent: 25}
+	r := httptest.NewRequest("POST", "/0", nil)
+	matched := 0
+	for i := 0; i < 10000; i++ {
+		if fault.matches("0", r) {
+			matched++
+		}
+	}
+	if matched < 2200 || matched > 2800 {
+		t.Errorf("%d of 10000 requests matched a 25%% fault, want about 2500", matched)
+	}
+}
+
+// faultServer answers "response" to every request, after injecting faults
+func faultServer(t *testing.T, faults ...Fault) *httptest.Server {
+	injector := NewFaultInjector(nil, nil)
+	if err := injector.Set(faults); err != nil {
+		t.Fatal(err)
+	}
+	faultInjector = injector
+
+	span := opentracing.NoopTracer{}.StartSpan("test")
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, _, done := injectFault(w, r, strings.TrimPrefix(r.URL.Path, "/"), span)
+		if done {
+			return
+		}
+		w.Write([]byte("response"))
+	}))
+}
+
+func TestInjectFault(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults []Fault
+		path   string
+		status int
+		body   string
+		// broken reports whether the client sees the connection dropped
+		broken bool
+		// elapsed is the least time the response takes
+		elapsed time.Duration
+	}{
+		{name: "no fault", path: "/0", status: http.StatusOK, body: "response"},
+		{name: "error", faults: []Fault{{Type: faultError, Code: 500}}, path: "/0", status: 500, body: "\x00"},
+		{name: "error on another endpoint", faults: []Fault{{Type: faultError, Endpoint: "1"}}, path: "/0", status: http.StatusOK, body: "response"},
+		{name: "delay", faults: []Fault{{Type: faultDelay, Delay: "50ms"}}, path: "/0", status: http.StatusOK, body: "response", elapsed: 50 * time.Millisecond},
+		{
+			name:    "delay then error",
+			faults:  []Fault{{Type: faultDelay, Delay: "50ms"}, {Type: faultError}},
+			path:    "/0",
+			status:  http.StatusServiceUnavailable,
+			body:    "\x00",
+			elapsed: 50 * time.Millisecond,
+		},
+		{name: "reset", faults: []Fault{{Type: faultReset}}, path: "/0", broken: true},
+		{name: "hang for a while", faults: []Fault{{Type: faultHang, Delay: "50ms"}}, path: "/0", broken: true, elapsed: 50 * time.Millisecond},
+		{name: "truncate", faults: []Fault{{Type: faultTruncate}}, path: "/0", status: http.StatusOK, broken: true},
+	}
+
+	defer func(injector *FaultInjector) { faultInjector = injector }(faultInjector)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := faultServer(t, test.faults...)
+			defer server.Close()
+
+			start := time.Now()
+			resp, err := http.Post(server.URL+test.path, "application/octet-stream", nil)
+			if err == nil {
+				defer resp.Body.Close()
+				var body []byte
+				body, err = io.ReadAll(resp.Body)
+				if err == nil && (resp.StatusCode != test.status || string(body) != test.body) {
+					t.Errorf("response = %d %q, want %d %q", resp.StatusCode, body, test.status, test.body)
+				}
+			}
+			if broken := err != nil; broken != test.broken {
+				t.Errorf("connection dropped = %v (%v), want %v", broken, err, test.broken)
+			}
+			if elapsed := time.Since(start); elapsed < test.elapsed {
+				t.Errorf("response took %v, want at least %v", elapsed, test.elapsed)
+			}
+		})
+	}
+}
+
+func TestInjectFaultHangUntilClientGivesUp(t *testing.T) {
+	defer func(injector *FaultInjector) { faultInjector = injector }(faultInjector)
+	server := faultServer(t, Fault{Type: faultHang})
+	defer server.Close()
+
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	if resp, err := client.Post(server.URL+"/0", "application/octet-stream", nil); err == nil {
+		resp.Body.Close()
+		t.Fatalf("status = %d, want the request to hang", resp.StatusCode)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+const (
+	hedgeSame    = "same"
+	hedgeReplica = "replica"
+
+	// latencies kept per target to compute the hedge percentile
+	hedgeSamples = 512
+	// calls to a target before the percentile is trusted
+	hedgeMinSamples = 20
+	// time the addresses of a target hedged to a replica are kept
+	hedgeResolveTTL = 10 * time.Second
+)
+
+var (
+	hedgeTarget string
+	hedgeDelay  = hedgeDelayFlag{}
+)
+
+// hedgeDelayFlag is the time to wait for a downstream call before sending a hedge:
+// a fixed duration, or pNN for the NNth percentile of the latency of the target
+type hedgeDelayFlag struct {
+	delay      time.Duration
+	percentile float64
+}
+
+func (f *hedgeDelayFlag) String() string {
+	if f.percentile > 0 {
+		return "p" + strconv.FormatFloat(f.percentile, 'g', -1, 64)
+	}
+	return f.delay.String()
+}
+
+func (f *hedgeDelayFlag) Set(value string) error {
+	if strings.HasPrefix(value, "p") {
+		percentile, err := strconv.ParseFloat(value[1:], 64)
+		if err != nil || percentile <= 0 || percentile >= 100 {
+			return fmt.Errorf("percentile must be in (0, 100)")
+		}
+		f.delay, f.percentile = 0, percentile
+		return nil
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	f.delay, f.percentile = delay, 0
+	return nil
+}
+
+func (f *hedgeDelayFlag) enabled() bool {
+	return f.delay > 0 || f.percentile > 0
+}
+
+// get returns the delay before hedging a call to target, 0 means no hedge
+func (f *hedgeDelayFlag) get(target string) time.Duration {
+	if f.percentile > 0 {
+		return latencyOf(target).percentile(f.percentile)
+	}
+	return f.delay
+}
+
+// latencyWindow keeps the latest latencies of the successful calls to a target
+type latencyWindow struct {
+	mux     sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+var (
+	latenciesMux sync.Mutex
+	latencies    = map[string]*latencyWindow{}
+)
+
+func latencyOf(target string) *latencyWindow {
+	latenciesMux.Lock()
+	defer latenciesMux.Unlock()
+
+	window, ok := latencies[target]
+	if !ok {
+		window = &latencyWindow{samples: make([]time.Duration, 0, hedgeSamples)}
+		latencies[target] = window
+	}
+	return window
+}
+
+func (l *latencyWindow) add(latency time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if len(l.samples) < hedgeSamples {
+		l.samples = append(l.samples, latency)
+		return
+	}
+	l.samples[l.next] = latency
+	l.next = (l.next + 1) % hedgeSamples
+}
+
+// percentile returns the pth percentile of the latencies, 0 until there are enough of them
+func (l *latencyWindow) percentile(p float64) time.Duration {
+	l.mux.Lock()
+	if len(l.samples) < hedgeMinSamples {
+		l.mux.Unlock()
+		return 0
+	}
+	sorted := append([]time.Duration(nil), l.samples...)
+	l.mux.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+type hedgeResult struct {
+	target     string
+	hedge      bool
+	body       []byte
+	code       int
+	httpStatus int
+}
+
+// sendHedged sends body to target and, if no answer came after the hedge delay,
+// a duplicate to target or, with --hedge-target=replica, to one of the addresses of target.
+// The first successful answer wins and the other call is cancelled; the hedge has
+// its own span following span. It returns like sendRequest.
+func sendHedged(ctx context.Context, target string, requestType string, body []byte, tracer *opentracing.Tracer, span *opentracing.Span) ([]byte, int, int) {
+	if !hedgeDelay.enabled() {
+		return sendRequest(ctx, target, requestType, body, tracer, span)
+	}
+
+	// the call that loses is cancelled when this returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	send := func(addr string, hedge bool, span *opentracing.Span) {
+		start := time.Now()
+		responseBody, code, httpStatus := sendRequestTo(ctx, target, addr, requestType, body, tracer, span)
+		if httpStatus == http.StatusOK {
+			latencyOf(target).add(time.Since(start))
+		}
+		results <- hedgeResult{target: addr, hedge: hedge, body: responseBody, code: code, httpStatus: httpStatus}
+	}
+	go send(target, false, span)
+
+	delay := hedgeDelay.get(target)
+	if delay <= 0 {
+		result := <-results
+		return result.body, result.code, result.httpStatus
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		// answered before the delay, there is nothing to hedge
+		return result.body, result.code, result.httpStatus
+	case <-timer.C:
+	}
+
+	hedgeAddr := hedgeAddress(ctx, target)
+	log.Printf("hedging %s to %s after %v\n", target, hedgeAddr, delay)
+	(*span).LogKV("event", "hedge", "target", hedgeAddr, "delay", delay.String())
+	hedgesTotal.WithLabelValues(target, requestType).Inc()
+
+	hedgeSpan := (*tracer).StartSpan(requestType, opentracing.FollowsFrom((*span).Context()), opentracing.Tag{Key: "hedge", Value: true})
+	go func() {
+		send(hedgeAddr, true, &hedgeSpan)
+		hedgeSpan.Finish()
+	}()
+
+	var last hedgeResult
+	for pending := 2; pending > 0; pending-- {
+		last = <-results
+		if last.httpStatus == http.StatusOK {
+			if last.hedge {
+				hedgeWinsTotal.WithLabelValues(target, requestType).Inc()
+			}
+			(*span).LogKV("event", "hedge winner", "target", last.target, "hedge", last.hedge)
+			return last.body, last.code, last.httpStatus
+		}
+	}
+	return last.body, last.code, last.httpStatus
+}
+
+// resolvedTarget is the addresses a target resolved to, until expires
+type resolvedTarget struct {
+	addrs   []string
+	expires time.Time
+}
+
+var (
+	resolvedMux sync.Mutex
+	resolved    = map[string]resolvedTarget{}
+)
+
+// hedgeAddress returns where the hedge of a call to target goes: target itself
+// unless --hedge-target=replica, then one of the addresses target resolves to,
+// e.g. the replicas behind a headless Kubernetes service, picked at random.
+// The addresses are looked up once per hedgeResolveTTL
+func hedgeAddress(ctx context.Context, target string) string {
+	if hedgeTarget != hedgeReplica {
+		return target
+	}
+
+	resolvedMux.Lock()
+	entry, ok := resolved[target]
+	resolvedMux.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, target)
+		if err != nil && ctx.Err() != nil {
+			// the call is over, the next one looks target up again
+			return target
+		}
+		if err != nil {
+			log.Printf("cannot resolve %s to hedge to a replica: %v\n", target, err)
+		}
+		entry = resolvedTarget{addrs: addrs, expires: time.Now().Add(hedgeResolveTTL)}
+		resolvedMux.Lock()
+		resolved[target] = entry
+		resolvedMux.Unlock()
+	}
+	if len(entry.addrs) == 0 {
+		return target
+	}
+	return entry.addrs[rand.Intn(len(entry.addrs))]
+}
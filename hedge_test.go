@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestHedgeDelayFlag(t *testing.T) {
+	tests := []struct {
+		value      string
+		delay      time.Duration
+		percentile float64
+		enabled    bool
+		err        bool
+	}{
+		{value: "0", enabled: false},
+		{value: "50ms", delay: 50 * time.Millisecond, enabled: true},
+		{value: "p95", percentile: 95, enabled: true},
+		{value: "p99.9", percentile: 99.9, enabled: true},
+		{value: "p0", err: true},
+		{value: "p100", err: true},
+		{value: "pfast", err: true},
+		{value: "soon", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			flag := hedgeDelayFlag{}
+			err := flag.Set(test.value)
+			if (err != nil) != test.err {
+				t.Fatalf("Set(%s) error = %v, want an error: %v", test.value, err, test.err)
+			}
+			if test.err {
+				return
+			}
+			if flag.delay != test.delay || flag.percentile != test.percentile || flag.enabled() != test.enabled {
+				t.Errorf("Set(%s) = %+v, enabled %v, want delay %v, percentile %g, enabled %v",
+					test.value, flag, flag.enabled(), test.delay, test.percentile, test.enabled)
+			}
+			if test.value != "0" && flag.String() != test.value {
+				t.Errorf("String() = %s, want %s", flag.String(), test.value)
+			}
+		})
+	}
+}
+
+func TestLatencyWindowPercentile(t *testing.T) {
+	window := &latencyWindow{}
+	for i := 1; i < hedgeMinSamples; i++ {
+		window.add(time.Duration(i) * time.Millisecond)
+	}
+	if p := window.percentile(50); p != 0 {
+		t.Errorf("percentile(50) = %v with %d samples, want 0", p, hedgeMinSamples-1)
+	}
+
+	window = &latencyWindow{}
+	for i := 100; i > 0; i-- {
+		window.add(time.Duration(i) * time.Millisecond)
+	}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{p: 50, want: 50 * time.Millisecond},
+		{p: 95, want: 95 * time.Millisecond},
+		{p: 99.5, want: 100 * time.Millisecond},
+		{p: 0.1, want: time.Millisecond},
+	}
+	for _, test := range tests {
+		if p := window.percentile(test.p); p != test.want {
+			t.Errorf("percentile(%g) = %v, want %v", test.p, p, test.want)
+		}
+	}
+
+	// the window keeps only the latest samples
+	for i := 0; i < hedgeSamples; i++ {
+		window.add(time.Second)
+	}
+	if p := window.percentile(1); p != time.Second {
+		t.Errorf("percentile(1) = %v after the window filled with 1s, want 1s", p)
+	}
+}
+
+func TestSendHedged(t *testing.T) {
+	tests := []struct {
+		name string
+		// slow is the number of calls that hang until they are cancelled
+		slow   int32
+		delay  string
+		target string
+		calls  int32
+		status int
+	}{
+		{name: "hedging disabled", delay: "0", calls: 1, status: http.StatusOK},
+		{name: "answered before the delay", delay: "1s", calls: 1, status: http.StatusOK},
+		{name: "the hedge wins", slow: 1, delay: "20ms", calls: 2, status: http.StatusOK},
+		{name: "percentile without enough samples", delay: "p90", calls: 1, status: http.StatusOK},
+		{name: "the hedge goes to a replica", slow: 1, delay: "20ms", target: hedgeReplica, calls: 2, status: http.StatusOK},
+	}
+
+	defer func(port string, delay hedgeDelayFlag, target string) {
+		globalPort, hedgeDelay, hedgeTarget = port, delay, target
+	}(globalPort, hedgeDelay, hedgeTarget)
+	tracer := opentracing.Tracer(opentracing.NoopTracer{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int32
+			hosts := make(chan string, 2)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// the server notices the client went away only once the body is read
+				io.Copy(io.Discard, r.Body)
+				hosts <- r.Host
+				if atomic.AddInt32(&calls, 1) <= test.slow {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(5 * time.Second):
+					}
+					return
+				}
+				w.Write([]byte("ok"))
+			}))
+			defer server.Close()
+
+			target, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			globalPort, hedgeTarget = port, hedgeSame
+			if test.target != "" {
+				hedgeTarget = test.target
+			}
+			hedgeDelay = hedgeDelayFlag{}
+			if err := hedgeDelay.Set(test.delay); err != nil {
+				t.Fatal(err)
+			}
+
+			span := tracer.StartSpan("test")
+			start := time.Now()
+			body, code, status := sendHedged(context.Background(), target, "0", []byte("body"), &tracer, &span)
+			if status != test.status || code != http.StatusOK || string(body) != "ok" {
+				t.Errorf("sendHedged() = %q, %d, %d, want %q, 200, %d", body, code, status, "ok", test.status)
+			}
+			if calls := atomic.LoadInt32(&calls); calls != test.calls {
+				t.Errorf("%d calls, want %d", calls, test.calls)
+			}
+			if host := <-hosts; host != net.JoinHostPort(target, port) {
+				t.Errorf("first call sent to %s, want the target %s", host, target)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("sendHedged() took %v, want the fastest answer", elapsed)
+			}
+		})
+	}
+}
+
+func TestHedgeAddress(t *testing.T) {
+	defer func(target string) { hedgeTarget = target }(hedgeTarget)
+	resolvedMux.Lock()
+	resolved = map[string]resolvedTarget{}
+	resolvedMux.Unlock()
+
+	hedgeTarget = hedgeSame
+	if addr := hedgeAddress(context.Background(), "localhost"); addr != "localhost" {
+		t.Errorf("hedgeAddress(localhost) = %s with --hedge-target=same, want localhost", addr)
+	}
+	resolvedMux.Lock()
+	if len(resolved) != 0 {
+		t.Errorf("--hedge-target=same resolved %v, want no lookup", resolved)
+	}
+	resolvedMux.Unlock()
+
+	hedgeTarget = hedgeReplica
+	addrs, err := net.DefaultResolver.LookupHost(context.Background(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := hedgeAddress(context.Background(), "localhost")
+	found := false
+	for _, a := range addrs {
+		found = found || a == addr
+	}
+	if !found {
+		t.Errorf("hedgeAddress(localhost) = %s, want one of %v", addr, addrs)
+	}
+
+	// the addresses are cached until they expire
+	resolvedMux.Lock()
+	resolved["localhost"] = resolvedTarget{addrs: []string{"10.0.0.1"}, expires: time.Now().Add(time.Minute)}
+	resolvedMux.Unlock()
+	if addr := hedgeAddress(context.Background(), "localhost"); addr != "10.0.0.1" {
+		t.Errorf("hedgeAddress(localhost) = %s, want the cached 10.0.0.1", addr)
+	}
+	resolvedMux.Lock()
+	resolved["localhost"] = resolvedTarget{addrs: []string{"10.0.0.1"}, expires: time.Now().Add(-time.Second)}
+	resolvedMux.Unlock()
+	if addr := hedgeAddress(context.Background(), "localhost"); addr == "10.0.0.1" {
+		t.Error("hedgeAddress(localhost) answered an expired address")
+	}
+}
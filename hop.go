@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+)
+
+const (
+	hopSequential = "sequential"
+	hopParallel   = "parallel"
+	hopBranch     = "branch"
+)
+
+// Hop lists the calls a node makes on a path. In a topology file a hop is
+// either the name of the next node ("" for the last node) or an object:
+//
+//	mode: parallel          # sequential (default), parallel or branch
+//	calls:
+//	  - svc-1-mock          # called on every request
+//	  - target: svc-2-mock
+//	    probability: 0.3    # called on 30% of the requests
+//
+// In branch mode exactly one call is taken, chosen by probability. Calls
+// without a probability share what the others leave; if all probabilities
+// add up to less than 1 the remainder ends the path at this node.
+type Hop struct {
+	Mode  string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Calls []Call `json:"calls,omitempty" yaml:"calls,omitempty"`
+}
+
+// Call is a downstream call of a Hop. In a topology file a call is either the
+// target name or an object with target and probability.
+// A probability of 0 means the call is always taken.
+type Call struct {
+	Target      string  `json:"target" yaml:"target"`
+	Probability float64 `json:"probability,omitempty" yaml:"probability,omitempty"`
+}
+
+// nextHop returns the hop of a linear path calling target, or a terminal hop if target is ""
+func nextHop(target string) Hop {
+	if target == "" {
+		return Hop{}
+	}
+	return Hop{Calls: []Call{{Target: target}}}
+}
+
+// routeMapToPaths converts a route map generated by uApp-generator.py into topology paths
+func routeMapToPaths(routeMap map[string]map[string]string) map[string]map[string]Hop {
+	paths := make(map[string]map[string]Hop, len(routeMap))
+	for pathId, route := range routeMap {
+		paths[pathId] = make(map[string]Hop, len(route))
+		for node, next := range route {
+			paths[pathId][node] = nextHop(next)
+		}
+	}
+	return paths
+}
+
+// simple reports whether the hop is a single unconditional call or no call at all
+func (h Hop) simple() bool {
+	return len(h.Calls) == 0 || (len(h.Calls) == 1 && h.Mode != hopBranch && h.Calls[0].Probability == 0)
+}
+
+func (h Hop) mode() string {
+	if h.Mode == "" {
+		return hopSequential
+	}
+	return h.Mode
+}
+
+// targets draws the targets to call for one request
+func (h Hop) targets() []string {
+	if h.mode() == hopBranch {
+		weights := h.branchWeights()
+		draw := rand.Float64()
+		for i, call := range h.Calls {
+			if draw < weights[i] {
+				return []string{call.Target}
+			}
+			draw -= weights[i]
+		}
+		return nil
+	}
+
+	targets := make([]string, 0, len(h.Calls))
+	for _, call := range h.Calls {
+		if call.Probability == 0 || rand.Float64() < call.Probability {
+			targets = append(targets, call.Target)
+		}
+	}
+	return targets
+}
+
+// branchWeights returns the probability of taking each call in branch mode
+func (h Hop) branchWeights() []float64 {
+	weights := make([]float64, len(h.Calls))
+	remainder := 1.0
+	unset := 0
+	for i, call := range h.Calls {
+		weights[i] = call.Probability
+		remainder -= call.Probability
+		if call.Probability == 0 {
+			unset++
+		}
+	}
+	if unset > 0 && remainder > 0 {
+		for i := range weights {
+			if weights[i] == 0 {
+				weights[i] = remainder / float64(unset)
+			}
+		}
+	}
+	return weights
+}
+
+func (h Hop) validate() error {
+	switch h.mode() {
+	case hopSequential, hopParallel, hopBranch:
+	default:
+		return fmt.Errorf("unknown mode %s", h.Mode)
+	}
+
+	total := 0.0
+	for _, call := range h.Calls {
+		if call.Target == "" {
+			return fmt.Errorf("call without target")
+		}
+		if call.Probability < 0 || call.Probability > 1 {
+			return fmt.Errorf("probability %f of %s out of [0, 1]", call.Probability, call.Target)
+		}
+		total += call.Probability
+	}
+	if h.mode() == hopBranch && total > 1+1e-9 {
+		return fmt.Errorf("branch probabilities add up to %f", total)
+	}
+	return nil
+}
+
+func (h Hop) clone() Hop {
+	return Hop{Mode: h.Mode, Calls: append([]Call(nil), h.Calls...)}
+}
+
+// MarshalJSON writes simple hops as the target name so linear paths read back as written
+func (h Hop) MarshalJSON() ([]byte, error) {
+	if h.simple() {
+		target := ""
+		if len(h.Calls) > 0 {
+			target = h.Calls[0].Target
+		}
+		return json.Marshal(target)
+	}
+	type hop Hop
+	return json.Marshal(hop(h))
+}
+
+func (h *Hop) UnmarshalJSON(data []byte) error {
+	var target string
+	if err := json.Unmarshal(data, &target); err == nil {
+		*h = nextHop(target)
+		return nil
+	}
+	type hop Hop
+	return json.Unmarshal(data, (*hop)(h))
+}
+
+func (h *Hop) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var target string
+	if err := unmarshal(&target); err == nil {
+		*h = nextHop(target)
+		return nil
+	}
+	type hop Hop
+	return unmarshal((*hop)(h))
+}
+
+func (c *Call) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.Target); err == nil {
+		return nil
+	}
+	type call Call
+	return json.Unmarshal(data, (*call)(c))
+}
+
+func (c *Call) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.Target); err == nil {
+		return nil
+	}
+	type call Call
+	return unmarshal((*call)(c))
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// residentMemory is only available on linux
+func residentMemory() (uint64, bool) {
+	return 0, false
+}
@@ -2,56 +2,30 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"math"
 	"runtime"
 	"time"
 )
 
 var (
+	// epsilon is the size of a memory unit in MiB
 	epsilon = 32
 )
 
-func SetMemUsage(x int, y int, a float64, b float64, c float64, d float64, e float64, f float64, g float64, h float64) *[][]int8 {
-	var overall [][]int8
-	var i uint
-
+func SetMemUsage(x int, y int, a float64, b float64, c float64, d float64, e float64, f float64, g float64, h float64) *Ballast {
+	overall := NewBallast()
 	mem := getMemoryUsage(x, y, a, b, c, d, e, f, g, h)
-	for ; i < mem; i++ {
-		// Giga
-		a := make([]int8, 0, 1048576*epsilon)
-		overall = append(overall, a)
-		//memUsage(mem)
-		if i % 100 == 0 {
-			time.Sleep(time.Millisecond * 10)
-		}
-	}
-	memUsage(mem)
-	return &overall
+	overall.SetBase(mem)
+	return overall
 }
 
 func getMemoryUsage(x int, y int, a float64, b float64, c float64, d float64, e float64, f float64, g float64, h float64) uint {
-	var x_param float64
-	var y_param float64
-	if x%2 == 0 {
-		x_param = func_x_1(a, b, c, d)
-	} else {
-		x_param = func_x_2(d, e, h)
-	}
-	if y%2 == 0 {
-		y_param = func_y_1(a, c, e, f, g)
-	} else {
-		y_param = func_y_2(b, e, f)
-	}
-	return himmelblau(x_param, y_param)
+	return memoryUnits(coordinates(x, y, a, b, c, d, e, f, g, h))
 }
 
-func FreeMemUsed(overall *[][]int8) {
-	overall = nil
+func FreeMemUsed(overall *Ballast) {
 	fmt.Printf("free memory")
-	memUsage(0)
-	runtime.GC()
-	memUsage(0)
+	overall.SetBase(0)
 }
 
 func memUsage(expected uint) {
@@ -61,12 +35,15 @@ func memUsage(expected uint) {
 	fmt.Printf("Alloc = %v MiB", bToMb(m.Alloc))
 	fmt.Printf("\tTotalAlloc = %v MiB", bToMb(m.TotalAlloc))
 	fmt.Printf("\tSys = %v MiB", bToMb(m.Sys))
+	if rss, ok := residentMemory(); ok {
+		fmt.Printf("\tRSS = %v MiB", bToMb(rss))
+	}
 	fmt.Printf("\tNumGc = %v\n", m.NumGC)
 	fmt.Printf("\tExpected = %v\n", expected)
 }
 
 func bToMb(b uint64) uint64 {
-	return b / uint64(epsilon) / 1024 / 1024
+	return b / 1024 / 1024
 }
 
 // https://caffinc.github.io/2016/03/cpu-load-generator/
@@ -75,19 +52,7 @@ func InfinityCpuUsage(x int, y int, a float64, b float64, c float64, d float64,
 }
 
 func getCpuUsage(x int, y int, a float64, b float64, c float64, d float64, e float64, f float64, g float64, h float64) float64 {
-	var x_param float64
-	var y_param float64
-	if x%2 == 0 {
-		x_param = func_x_1(a, b, c, d)
-	} else {
-		x_param = func_x_2(d, e, h)
-	}
-	if y%2 == 0 {
-		y_param = func_y_1(a, c, e, f, g)
-	} else {
-		y_param = func_y_2(b, e, f)
-	}
-	return beale(x_param, y_param) * 100
+	return cpuLoad(coordinates(x, y, a, b, c, d, e, f, g, h)) * 100
 }
 
 // set CPU usage in $load% for $timeElapsed ms
@@ -108,44 +73,17 @@ func FinityCpuUsage(timeElapsed uint, x int, y int, a float64, b float64, c floa
 	return elapsed
 }
 
-func beale(x float64, y float64) float64 {
-	var val = 0.0
-	// We use our range as [-4.5, 4.5] because it starts to grow too rapidly beyond those values
-	if x >= -4.5 && x <= 4.5 && y >= -4.5 && y <= 4.5 {
-		// Beale Function
-		val = math.Pow((1.5-x+x*y), 2) + math.Pow((2.25-x+(x*math.Pow(y, 2))), 2) + math.Pow((2.625-x+(x*math.Pow(y, 3))), 2)
-		// Maximum for this function is approx. 178000, so we can normalize it to a value between 0 and 0.2 by dividing by 890000
-		val = val/890000 + 0.8 // Make it a value between 0.2 and 1.0
-		log.Printf("beale(%f, %f) val: %f\n", x, y, val)
-	} else {
-		// For these cases, we received values outside of our valid search domains
-		// Therefore, let's just use a catch-all function that'll take any parameters
-
-		val = 0.5 * (math.Sin(math.Min(x,y) * math.Pi) + 1)/2
-		log.Printf("beale fallback (math.Sin((%f*%f) * math.Pi) + 1)/2 = %f\n", x, y, val)
-	}
-	// to maximize the value
-	return 1-val
-}
-
-func himmelblau(x float64, y float64) uint {
-	var pct = 0.0
-	if x >= -5 && x <= 5 && y >= -5 && y <= 5 {
-		// Himmelblau Function
-		pct = math.Pow(math.Pow(x, 2)+y-11, 2) + math.Pow(x+math.Pow(y, 2)-7, 2)
-		// Maximum for this function is approx. 890
-		pct = pct / 890 // make it a value between 0 and 1
-		log.Printf("himmelblau(%f, %f) val: %f\n", x, y, pct)
-	} else {
-		// For these cases, we received values outside of our valid search domains
-		// Therefore, let's just use a catch-all function that'll take any parameters
-		pct = 0.5 * (math.Cos(math.Min(x,y) * math.Pi) + 1)/2
-		log.Printf("himmelblau fallback (math.Cos((%f*%f) * math.Pi) + 1)/2 = %f\n", x, y, pct)
-	}
-	pct = 1- pct
-	// this can be changed; let's use 1024 as our maximum and 0 as our minimum
-	val := uint(float64(1024) * pct) // note that we're changing it to a uint32 => nearest integer val
-	return val
+// coordinateFunctions are the functions deriving the coordinates with the
+// parameters they use: x picks x_1 when even and x_2 when odd, y picks y_1
+// when even and y_2 when odd
+var coordinateFunctions = []struct {
+	name       string
+	parameters []string
+}{
+	{"x_1", []string{"x", "a", "b", "c", "d"}},
+	{"x_2", []string{"x", "d", "e", "h"}},
+	{"y_1", []string{"y", "a", "c", "e", "f", "g"}},
+	{"y_2", []string{"y", "b", "e", "f"}},
 }
 
 func func_x_1(a float64, b float64, c float64, d float64) float64 {
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	objectiveCpu        = "cpu"
+	objectiveMemory     = "memory"
+	objectiveLatency    = "latency"
+	objectiveThroughput = "throughput"
+
+	// requests per second of a service whose throughput function is at its minimum
+	maxRequestsPerSecond = 2000
+	// points per axis sampled to find the range of a custom expression
+	expressionGrid = 200
+)
+
+var (
+	cpuFunction        string
+	memoryFunction     string
+	latencyFunction    string
+	throughputFunction string
+	maxLatency         time.Duration
+	cpuObjective       = objectives["beale"]
+	memoryObjective    = objectives["himmelblau"]
+	// latencyObjective and throughputObjective are nil when the function is none
+	latencyObjective    *Objective
+	throughputObjective *Objective
+)
+
+// Objective is a benchmark function of the two coordinates derived from the
+// parameters, with the domain it is evaluated on and its range over that domain
+type Objective struct {
+	Name     string                     `json:"name"`
+	Formula  string                     `json:"formula"`
+	XMin     float64                    `json:"xMin"`
+	XMax     float64                    `json:"xMax"`
+	YMin     float64                    `json:"yMin"`
+	YMax     float64                    `json:"yMax"`
+	Min      float64                    `json:"min"`
+	Max      float64                    `json:"max"`
+	function func(x, y float64) float64 `json:"-"`
+}
+
+// objectives are the registered benchmark functions
+var objectives = map[string]*Objective{
+	"beale": {
+		Name: "beale", Formula: "(1.5-x+xy)^2 + (2.25-x+xy^2)^2 + (2.625-x+xy^3)^2",
+		// We use our range as [-4.5, 4.5] because it starts to grow too rapidly beyond those values
+		XMin: -4.5, XMax: 4.5, YMin: -4.5, YMax: 4.5,
+		// Maximum for this function is approx. 178000
+		Min: 0, Max: 178000,
+		function: func(x, y float64) float64 {
+			return math.Pow((1.5-x+x*y), 2) + math.Pow((2.25-x+(x*math.Pow(y, 2))), 2) + math.Pow((2.625-x+(x*math.Pow(y, 3))), 2)
+		},
+	},
+	"himmelblau": {
+		Name: "himmelblau", Formula: "(x^2+y-11)^2 + (x+y^2-7)^2",
+		XMin: -5, XMax: 5, YMin: -5, YMax: 5,
+		// Maximum for this function is approx. 890
+		Min: 0, Max: 890,
+		function: func(x, y float64) float64 {
+			return math.Pow(math.Pow(x, 2)+y-11, 2) + math.Pow(x+math.Pow(y, 2)-7, 2)
+		},
+	},
+	"rosenbrock": {
+		Name: "rosenbrock", Formula: "(1-x)^2 + 100(y-x^2)^2",
+		XMin: -2, XMax: 2, YMin: -1, YMax: 3,
+		Min: 0, Max: 2509,
+		function: func(x, y float64) float64 {
+			return math.Pow(1-x, 2) + 100*math.Pow(y-x*x, 2)
+		},
+	},
+	"rastrigin": {
+		Name: "rastrigin", Formula: "20 + x^2 - 10cos(2 pi x) + y^2 - 10cos(2 pi y)",
+		XMin: -5.12, XMax: 5.12, YMin: -5.12, YMax: 5.12,
+		Min: 0, Max: 80.705,
+		function: func(x, y float64) float64 {
+			return 20 + x*x - 10*math.Cos(2*math.Pi*x) + y*y - 10*math.Cos(2*math.Pi*y)
+		},
+	},
+	"ackley": {
+		Name: "ackley", Formula: "-20exp(-0.2sqrt((x^2+y^2)/2)) - exp((cos(2 pi x)+cos(2 pi y))/2) + e + 20",
+		XMin: -5, XMax: 5, YMin: -5, YMax: 5,
+		Min: 0, Max: 14.303,
+		function: func(x, y float64) float64 {
+			return -20*math.Exp(-0.2*math.Sqrt(0.5*(x*x+y*y))) - math.Exp(0.5*(math.Cos(2*math.Pi*x)+math.Cos(2*math.Pi*y))) + math.E + 20
+		},
+	},
+	"branin": {
+		Name: "branin", Formula: "(y - 5.1x^2/(4 pi^2) + 5x/pi - 6)^2 + 10(1 - 1/(8 pi))cos(x) + 10",
+		XMin: -5, XMax: 10, YMin: 0, YMax: 15,
+		Min: 0.397887, Max: 308.129,
+		function: func(x, y float64) float64 {
+			return math.Pow(y-5.1/(4*math.Pi*math.Pi)*x*x+5/math.Pi*x-6, 2) + 10*(1-1/(8*math.Pi))*math.Cos(x) + 10
+		},
+	},
+}
+
+// objectiveNames returns the names of the registered functions
+func objectiveNames() []string {
+	names := make([]string, 0, len(objectives))
+	for name := range objectives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newObjective builds an objective from a spec of the form name[:key=value,...].
+// Every function takes x=min/max and y=min/max to change its domain; expr takes
+// the formula of x and y in f, e.g. expr:f=x^2+sin(y),x=-5/5,y=-5/5, and
+// min/max when its range over the domain is not to be sampled
+func newObjective(spec string) (*Objective, error) {
+	name, params, err := parseDistributionSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var objective Objective
+	if name == "expr" {
+		formula, ok := params["f"]
+		if !ok {
+			return nil, fmt.Errorf("%s: missing f", spec)
+		}
+		function, err := parseExpression(formula)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", spec, err)
+		}
+		objective = Objective{Name: name, Formula: formula, XMin: -5, XMax: 5, YMin: -5, YMax: 5, function: function}
+	} else {
+		registered, ok := objectives[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s, expected expr or one of %s", name, strings.Join(objectiveNames(), ", "))
+		}
+		objective = *registered
+	}
+
+	for key, value := range params {
+		switch key {
+		case "f":
+		case "x", "y":
+			bounds := strings.Split(value, "/")
+			if len(bounds) != 2 {
+				return nil, fmt.Errorf("%s: %s must be min/max", spec, key)
+			}
+			low, errLow := strconv.ParseFloat(strings.TrimSpace(bounds[0]), 64)
+			high, errHigh := strconv.ParseFloat(strings.TrimSpace(bounds[1]), 64)
+			if errLow != nil || errHigh != nil || low >= high {
+				return nil, fmt.Errorf("%s: %s must be min/max with min < max", spec, key)
+			}
+			if key == "x" {
+				objective.XMin, objective.XMax = low, high
+			} else {
+				objective.YMin, objective.YMax = low, high
+			}
+		case "min", "max":
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("%s: %s is not a number", spec, key)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown parameter %s", spec, key)
+		}
+	}
+
+	// the range of a registered function is only known over its own domain
+	_, hasX := params["x"]
+	_, hasY := params["y"]
+	if name == "expr" || hasX || hasY {
+		objective.sampleRange()
+	}
+	objective.Min = params.get("min", objective.Min)
+	objective.Max = params.get("max", objective.Max)
+	if !(objective.Min < objective.Max) {
+		return nil, fmt.Errorf("%s: the range of the function is empty, set min and max", spec)
+	}
+	return &objective, nil
+}
+
+// sampleRange sets the range of the function to the lowest and highest values on a grid over the domain
+func (o *Objective) sampleRange() {
+	o.Min, o.Max = math.Inf(1), math.Inf(-1)
+	for i := 0; i <= expressionGrid; i++ {
+		for j := 0; j <= expressionGrid; j++ {
+			x := o.XMin + (o.XMax-o.XMin)*float64(i)/expressionGrid
+			y := o.YMin + (o.YMax-o.YMin)*float64(j)/expressionGrid
+			if value := o.function(x, y); !math.IsNaN(value) && !math.IsInf(value, 0) {
+				o.Min, o.Max = math.Min(o.Min, value), math.Max(o.Max, value)
+			}
+		}
+	}
+}
+
+// Normalize returns f(x, y) scaled to [0, 1] over the range of the function,
+// or false when (x, y) is outside the domain
+func (o *Objective) Normalize(x float64, y float64) (float64, bool) {
+	// NaN coordinates are outside every domain
+	if !(x >= o.XMin && x <= o.XMax && y >= o.YMin && y <= o.YMax) {
+		return 0, false
+	}
+	value := (o.function(x, y) - o.Min) / (o.Max - o.Min)
+	log.Printf("%s(%f, %f) val: %f\n", o.Name, x, y, value)
+	return value, true
+}
+
+// String returns the name of the objective, none for no function
+func (o *Objective) String() string {
+	if o == nil {
+		return "none"
+	}
+	return o.Name
+}
+
+// coordinates derives the point the objective functions are evaluated at from the parameters
+func coordinates(x int, y int, a float64, b float64, c float64, d float64, e float64, f float64, g float64, h float64) (float64, float64) {
+	var x_param float64
+	var y_param float64
+	if x%2 == 0 {
+		x_param = func_x_1(a, b, c, d)
+	} else {
+		x_param = func_x_2(d, e, h)
+	}
+	if y%2 == 0 {
+		y_param = func_y_1(a, c, e, f, g)
+	} else {
+		y_param = func_y_2(b, e, f)
+	}
+	return x_param, y_param
+}
+
+// outsideDomain is the value of (x, y) outside the domain of a function:
+// a catch-all function that'll take any parameters, in [0, 0.5]
+func outsideDomain(name string, x float64, y float64, wave func(float64) float64) float64 {
+	value := 0.5 * (wave(math.Min(x, y)*math.Pi) + 1) / 2
+	log.Printf("%s fallback (%f, %f) = %f\n", name, x, y, value)
+	return value
+}
+
+// cpuLoad returns the CPU load in [0, 1] at (x, y): in [0, 0.2] within the
+// domain of the CPU function, the lower the function the higher the load
+func cpuLoad(x float64, y float64) float64 {
+	value, ok := cpuObjective.Normalize(x, y)
+	if !ok {
+		return 1 - outsideDomain(cpuObjective.Name, x, y, math.Sin)
+	}
+	// Make it a value between 0.2 and 1.0, to maximize the value
+	return 1 - (value*0.2 + 0.8)
+}
+
+// memoryUnits returns the memory units in [0, 1024] at (x, y), the lower the function the more memory
+func memoryUnits(x float64, y float64) uint {
+	value, ok := memoryObjective.Normalize(x, y)
+	if !ok {
+		value = outsideDomain(memoryObjective.Name, x, y, math.Cos)
+	}
+	if math.IsNaN(value) {
+		// an unknown memory holds no ballast, not the whole of it
+		return 0
+	}
+	// this can be changed; let's use 1024 as our maximum and 0 as our minimum
+	return uint(float64(1024) * (1 - value))
+}
+
+// latencyAt returns the latency added to every message at (x, y), up to maxLatency
+// at the maximum of the latency function
+func latencyAt(x float64, y float64) time.Duration {
+	if latencyObjective == nil {
+		return 0
+	}
+	value, ok := latencyObjective.Normalize(x, y)
+	if !ok {
+		value = outsideDomain(latencyObjective.Name, x, y, math.Cos)
+	}
+	return time.Duration(math.Max(0, value) * float64(maxLatency))
+}
+
+// requestsPerSecondAt returns the requests per second of the service at (x, y),
+// maxRequestsPerSecond at the minimum of the throughput function, or false
+// if there is no throughput function
+func requestsPerSecondAt(x float64, y float64) (float64, bool) {
+	if throughputObjective == nil {
+		return 0, false
+	}
+	value, ok := throughputObjective.Normalize(x, y)
+	if !ok {
+		value = outsideDomain(throughputObjective.Name, x, y, math.Cos)
+	}
+	return maxRequestsPerSecond * math.Max(0, 1-value), true
+}
+
+// setObjectives selects the objective functions from their specs; latency and
+// throughput take none to keep no function
+func setObjectives(cpu string, memory string, latency string, throughput string) error {
+	var err error
+	if cpuObjective, err = newObjective(cpu); err != nil {
+		return fmt.Errorf("invalid --cpu-function: %v", err)
+	}
+	if memoryObjective, err = newObjective(memory); err != nil {
+		return fmt.Errorf("invalid --memory-function: %v", err)
+	}
+	if latencyObjective, err = optionalObjective(latency); err != nil {
+		return fmt.Errorf("invalid --latency-function: %v", err)
+	}
+	if throughputObjective, err = optionalObjective(throughput); err != nil {
+		return fmt.Errorf("invalid --throughput-function: %v", err)
+	}
+	return nil
+}
+
+func optionalObjective(spec string) (*Objective, error) {
+	if spec == "" || strings.ToLower(spec) == "none" {
+		return nil, nil
+	}
+	return newObjective(spec)
+}
+
+// selectedObjectives returns the objective function of every resource
+func selectedObjectives() map[string]*Objective {
+	return map[string]*Objective{
+		objectiveCpu:        cpuObjective,
+		objectiveMemory:     memoryObjective,
+		objectiveLatency:    latencyObjective,
+		objectiveThroughput: throughputObjective,
+	}
+}
+
+// parseExpression compiles a formula of x and y with + - * / ^, parentheses,
+// the constants pi and e and the functions sin, cos, tan, exp, log, sqrt and abs
+func parseExpression(formula string) (func(x, y float64) float64, error) {
+	p := &expressionParser{input: formula}
+	p.next()
+	node, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		return nil, fmt.Errorf("unexpected %q at %d", p.token, p.pos)
+	}
+	return node, nil
+}
+
+type expressionParser struct {
+	input string
+	pos   int
+	token string
+}
+
+var expressionFunctions = map[string]func(float64) float64{
+	"sin": math.Sin, "cos": math.Cos, "tan": math.Tan, "exp": math.Exp,
+	"log": math.Log, "sqrt": math.Sqrt, "abs": math.Abs,
+}
+
+// next reads the next token: a number, a name or an operator, "" at the end
+func (p *expressionParser) next() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+	start := p.pos
+	switch {
+	case p.pos == len(p.input):
+	case unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '.':
+		for p.pos < len(p.input) && (unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+	case unicode.IsLetter(rune(p.input[p.pos])):
+		for p.pos < len(p.input) && unicode.IsLetter(rune(p.input[p.pos])) {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.token = p.input[start:p.pos]
+}
+
+func (p *expressionParser) sum() (func(x, y float64) float64, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "+" || p.token == "-" {
+		op := p.token
+		p.next()
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "+" {
+			left = func(x, y float64) float64 { return l(x, y) + right(x, y) }
+		} else {
+			left = func(x, y float64) float64 { return l(x, y) - right(x, y) }
+		}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) product() (func(x, y float64) float64, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "*" || p.token == "/" {
+		op := p.token
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "*" {
+			left = func(x, y float64) float64 { return l(x, y) * right(x, y) }
+		} else {
+			left = func(x, y float64) float64 { return l(x, y) / right(x, y) }
+		}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) unary() (func(x, y float64) float64, error) {
+	if p.token == "-" {
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(x, y float64) float64 { return -operand(x, y) }, nil
+	}
+	return p.power()
+}
+
+// power is right associative: x^2^3 is x^(2^3)
+func (p *expressionParser) power() (func(x, y float64) float64, error) {
+	base, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "^" {
+		return base, nil
+	}
+	p.next()
+	exponent, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(x, y float64) float64 { return math.Pow(base(x, y), exponent(x, y)) }, nil
+}
+
+func (p *expressionParser) operand() (func(x, y float64) float64, error) {
+	token := p.token
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of %q", p.input)
+	case token == "(":
+		p.next()
+		inner, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, fmt.Errorf("missing ) at %d", p.pos)
+		}
+		p.next()
+		return inner, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", token)
+		}
+		p.next()
+		return func(x, y float64) float64 { return value }, nil
+	}
+
+	p.next()
+	switch token {
+	case "x":
+		return func(x, y float64) float64 { return x }, nil
+	case "y":
+		return func(x, y float64) float64 { return y }, nil
+	case "pi":
+		return func(x, y float64) float64 { return math.Pi }, nil
+	case "e":
+		return func(x, y float64) float64 { return math.E }, nil
+	}
+	function, ok := expressionFunctions[token]
+	if !ok {
+		return nil, fmt.Errorf("unknown name %s", token)
+	}
+	if p.token != "(" {
+		return nil, fmt.Errorf("missing ( after %s", token)
+	}
+	argument, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return func(x, y float64) float64 { return function(argument(x, y)) }, nil
+}
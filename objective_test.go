@@ -0,0 +1,220 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewObjective(t *testing.T) {
+	tests := []struct {
+		spec string
+		// err is a substring of the error expected, "" for a valid spec
+		err                    string
+		name                   string
+		xMin, xMax, yMin, yMax float64
+		min, max               float64
+	}{
+		{spec: "beale", name: "beale", xMin: -4.5, xMax: 4.5, yMin: -4.5, yMax: 4.5, min: 0, max: 178000},
+		{spec: "himmelblau", name: "himmelblau", xMin: -5, xMax: 5, yMin: -5, yMax: 5, min: 0, max: 890},
+		{spec: "rosenbrock:min=0,max=100", name: "rosenbrock", xMin: -2, xMax: 2, yMin: -1, yMax: 3, min: 0, max: 100},
+		// the range is sampled again over the new domain: (1-x)^2 + 100(y-x^2)^2 over [0, 1]^2
+		{spec: "rosenbrock:x=0/1,y=0/1", name: "rosenbrock", xMin: 0, xMax: 1, yMin: 0, yMax: 1, min: 0, max: 101},
+		{spec: "expr:f=x+y,x=0/1,y=0/2", name: "expr", xMin: 0, xMax: 1, yMin: 0, yMax: 2, min: 0, max: 3},
+		{spec: "expr:f=x*y,min=-1,max=1", name: "expr", xMin: -5, xMax: 5, yMin: -5, yMax: 5, min: -1, max: 1},
+		{spec: "sphere", err: "unknown function sphere"},
+		{spec: "expr", err: "missing f"},
+		{spec: "expr:f=x+", err: "expr:f=x+"},
+		{spec: "beale:x=1", err: "x must be min/max"},
+		{spec: "beale:x=2/1", err: "min < max"},
+		{spec: "beale:max=lots", err: "max is not a number"},
+		{spec: "beale:scale=2", err: "unknown parameter scale"},
+		{spec: "expr:f=1", err: "range of the function is empty"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			objective, err := newObjective(test.spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("newObjective(%s) error = %v, want %q", test.spec, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newObjective(%s) error = %v", test.spec, err)
+			}
+
+			if objective.Name != test.name {
+				t.Errorf("name = %s, want %s", objective.Name, test.name)
+			}
+			if objective.XMin != test.xMin || objective.XMax != test.xMax || objective.YMin != test.yMin || objective.YMax != test.yMax {
+				t.Errorf("domain = [%g, %g] x [%g, %g], want [%g, %g] x [%g, %g]",
+					objective.XMin, objective.XMax, objective.YMin, objective.YMax, test.xMin, test.xMax, test.yMin, test.yMax)
+			}
+			if math.Abs(objective.Min-test.min) > 1e-9 || math.Abs(objective.Max-test.max) > 1e-9 {
+				t.Errorf("range = [%g, %g], want [%g, %g]", objective.Min, objective.Max, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestNewObjectiveKeepsRegistry(t *testing.T) {
+	if _, err := newObjective("beale:x=0/1,max=10"); err != nil {
+		t.Fatal(err)
+	}
+	if beale := objectives["beale"]; beale.XMin != -4.5 || beale.Max != 178000 {
+		t.Errorf("registered beale changed to %+v", beale)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	objective, err := newObjective("expr:f=x+y,x=0/1,y=0/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		x, y  float64
+		value float64
+		ok    bool
+	}{
+		{name: "minimum", x: 0, y: 0, value: 0, ok: true},
+		{name: "maximum", x: 1, y: 1, value: 1, ok: true},
+		{name: "middle", x: 0.5, y: 0.5, value: 0.5, ok: true},
+		{name: "x outside", x: 2, y: 0.5, ok: false},
+		{name: "y outside", x: 0.5, y: -1, ok: false},
+		{name: "undefined", x: math.NaN(), y: 0.5, ok: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, ok := objective.Normalize(test.x, test.y)
+			if ok != test.ok || (ok && math.Abs(value-test.value) > 1e-9) {
+				t.Errorf("Normalize(%g, %g) = %g, %v, want %g, %v", test.x, test.y, value, ok, test.value, test.ok)
+			}
+		})
+	}
+}
+
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		formula string
+		x, y    float64
+		value   float64
+		err     bool
+	}{
+		{formula: "x + y", x: 1, y: 2, value: 3},
+		{formula: "x - y - 1", x: 5, y: 2, value: 2},
+		{formula: "2 * x + y / 4", x: 3, y: 2, value: 6.5},
+		{formula: "(x + 1) * (y - 1)", x: 1, y: 3, value: 4},
+		{formula: "-x^2", x: 3, value: -9},
+		{formula: "2^3^2", value: 512},
+		{formula: "sqrt(x) + abs(y)", x: 16, y: -2, value: 6},
+		{formula: "sin(pi / 2) + log(e)", value: 2},
+		{formula: "exp(0) * cos(0)", value: 1},
+		{formula: "x +", err: true},
+		{formula: "(x + y", err: true},
+		{formula: "z", err: true},
+		{formula: "sinh(x)", err: true},
+		{formula: "x y", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.formula, func(t *testing.T) {
+			function, err := parseExpression(test.formula)
+			if test.err {
+				if err == nil {
+					t.Fatalf("parseExpression(%s) returned no error", test.formula)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExpression(%s) error = %v", test.formula, err)
+			}
+			if value := function(test.x, test.y); math.Abs(value-test.value) > 1e-9 {
+				t.Errorf("%s at (%g, %g) = %g, want %g", test.formula, test.x, test.y, value, test.value)
+			}
+		})
+	}
+}
+
+func TestObjectiveMapping(t *testing.T) {
+	// x + y over [0, 1]^2 normalizes to (x + y) / 2
+	objective, err := newObjective("expr:f=x+y,x=0/1,y=0/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(cpu, memory, latency, throughput *Objective) {
+		cpuObjective, memoryObjective, latencyObjective, throughputObjective = cpu, memory, latency, throughput
+	}(cpuObjective, memoryObjective, latencyObjective, throughputObjective)
+	defer func(latency time.Duration) { maxLatency = latency }(maxLatency)
+	cpuObjective, memoryObjective, latencyObjective, throughputObjective = objective, objective, objective, objective
+	maxLatency = 100 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		x, y    float64
+		load    float64
+		units   uint
+		latency float64
+		rps     float64
+	}{
+		{name: "minimum", x: 0, y: 0, load: 0.2, units: 1024, latency: 0, rps: maxRequestsPerSecond},
+		{name: "maximum", x: 1, y: 1, load: 0, units: 0, latency: 0.1, rps: 0},
+		{name: "middle", x: 0.5, y: 0.5, load: 0.1, units: 512, latency: 0.05, rps: maxRequestsPerSecond / 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if load := cpuLoad(test.x, test.y); math.Abs(load-test.load) > 1e-9 {
+				t.Errorf("cpuLoad() = %g, want %g", load, test.load)
+			}
+			if units := memoryUnits(test.x, test.y); units != test.units {
+				t.Errorf("memoryUnits() = %d, want %d", units, test.units)
+			}
+			if latency := latencyAt(test.x, test.y).Seconds(); math.Abs(latency-test.latency) > 1e-6 {
+				t.Errorf("latencyAt() = %gs, want %gs", latency, test.latency)
+			}
+			if rps, ok := requestsPerSecondAt(test.x, test.y); !ok || math.Abs(rps-test.rps) > 1e-6 {
+				t.Errorf("requestsPerSecondAt() = %g, %v, want %g", rps, ok, test.rps)
+			}
+		})
+	}
+
+	// outside the domain the fallback keeps the values in their bounds
+	if load := cpuLoad(5, 5); load < 0.5 || load > 1 {
+		t.Errorf("cpuLoad() outside the domain = %g, want it in [0.5, 1]", load)
+	}
+	if units := memoryUnits(math.NaN(), 0); units != 0 {
+		t.Errorf("memoryUnits() of undefined coordinates = %d, want 0", units)
+	}
+}
+
+func TestOptionalObjective(t *testing.T) {
+	tests := []struct {
+		spec string
+		none bool
+		err  bool
+	}{
+		{spec: "", none: true},
+		{spec: "none", none: true},
+		{spec: "None", none: true},
+		{spec: "ackley"},
+		{spec: "sphere", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			objective, err := optionalObjective(test.spec)
+			if (err != nil) != test.err {
+				t.Fatalf("optionalObjective(%s) error = %v", test.spec, err)
+			}
+			if !test.err && (objective == nil) != test.none {
+				t.Errorf("optionalObjective(%s) = %v, want none: %v", test.spec, objective, test.none)
+			}
+		})
+	}
+}
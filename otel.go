@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	prometheusbridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	otlpGrpc = "grpc"
+	otlpHttp = "http"
+)
+
+var (
+	otlpProtocol        string
+	otlpFile            string
+	otlpMetrics         bool
+	otlpMetricsInterval time.Duration
+
+	otlpFileOnce   sync.Once
+	otlpFileWriter io.Writer
+	otlpFileErr    error
+)
+
+// newOtlpTracer exports spans to the OpenTelemetry collector at collectorEndpoint
+// (host:port) over otlpProtocol, and to otlpFile as JSON lines when it is set.
+// An empty collectorEndpoint only writes the file.
+func newOtlpTracer(serviceName string, collectorEndpoint string, policy *SamplingPolicy) (opentracing.Tracer, io.Closer, error) {
+	ctx := context.Background()
+
+	res, err := otelResource(ctx, serviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(&otelSampler{policy: policy}),
+	}
+
+	if collectorEndpoint != "" {
+		exporter, err := newOtlpSpanExporter(ctx, collectorEndpoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		options = append(options, sdktrace.WithSpanProcessor(tailSpanProcessor{sdktrace.NewBatchSpanProcessor(exporter)}))
+	}
+	if otlpFile != "" {
+		w, err := openOtlpFile()
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, nil, err
+		}
+		// spans reach the file as soon as they end, so tests can read it right away
+		options = append(options, sdktrace.WithSpanProcessor(tailSpanProcessor{sdktrace.NewSimpleSpanProcessor(exporter)}))
+	}
+
+	provider := sdktrace.NewTracerProvider(options...)
+
+	// the bridge turns opentracing spans into OpenTelemetry spans and
+	// propagates W3C traceparent, tracestate and baggage headers
+	bridge, wrapper := otbridge.NewTracerPair(provider.Tracer(serviceName))
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	bridge.SetTextMapPropagator(propagator)
+	otel.SetTracerProvider(wrapper)
+	otel.SetTextMapPropagator(propagator)
+
+	return bridge, closerFunc(func() error { return provider.Shutdown(ctx) }), nil
+}
+
+// otelSampler samples the traces started by this service with policy and follows
+// the decision of the caller otherwise. Spans that were not sampled are still
+// recorded, without being exported, when policy may keep them once finished.
+type otelSampler struct {
+	policy *SamplingPolicy
+}
+
+func (s *otelSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	parent := trace.SpanContextFromContext(p.ParentContext)
+	result := sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: parent.TraceState()}
+	if parent.IsValid() {
+		if parent.IsSampled() {
+			result.Decision = sdktrace.RecordAndSample
+			return result
+		}
+	} else {
+		sampled, rule := s.policy.Sample(p.Name)
+		result.Attributes = []attribute.KeyValue{attribute.String(samplingRuleTag, rule)}
+		if sampled {
+			result.Decision = sdktrace.RecordAndSample
+			return result
+		}
+	}
+	if s.policy.Tail() {
+		result.Decision = sdktrace.RecordOnly
+	}
+	return result
+}
+
+func (s *otelSampler) Description() string {
+	return "SamplingPolicy"
+}
+
+// tailSpanProcessor exports the spans that were not sampled but were kept
+// once finished, with the opentracing sampling.priority tag
+type tailSpanProcessor struct {
+	sdktrace.SpanProcessor
+}
+
+func (p tailSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if !s.SpanContext().IsSampled() {
+		for _, attr := range s.Attributes() {
+			if string(attr.Key) == string(ext.SamplingPriority) && attr.Value.AsInt64() > 0 {
+				s = keptSpan{s}
+				break
+			}
+		}
+	}
+	p.SpanProcessor.OnEnd(s)
+}
+
+// keptSpan is a finished span marked as sampled
+type keptSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s keptSpan) SpanContext() trace.SpanContext {
+	return s.ReadOnlySpan.SpanContext().WithTraceFlags(trace.FlagsSampled)
+}
+
+func newOtlpSpanExporter(ctx context.Context, endpoint string) (sdktrace.SpanExporter, error) {
+	switch otlpProtocol {
+	case otlpGrpc:
+		return otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	case otlpHttp:
+		return otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	}
+	return nil, fmt.Errorf("unknown otlp protocol %s", otlpProtocol)
+}
+
+// startOtlpMetrics pushes every metric served on /metrics to the collector at
+// collectorEndpoint, and to otlpFile when it is set, every otlpMetricsInterval.
+// Closing the returned closer pushes the last values.
+func startOtlpMetrics(serviceName string, collectorEndpoint string) (io.Closer, error) {
+	ctx := context.Background()
+
+	res, err := otelResource(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	options := []sdkmetric.Option{sdkmetric.WithResource(res)}
+
+	// the Prometheus collectors stay the only source of metrics, the bridge
+	// reads them on every export
+	reader := func(exporter sdkmetric.Exporter) sdkmetric.Option {
+		return sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter,
+			sdkmetric.WithInterval(otlpMetricsInterval),
+			sdkmetric.WithProducer(prometheusbridge.NewMetricProducer()),
+		))
+	}
+
+	if collectorEndpoint != "" {
+		exporter, err := newOtlpMetricExporter(ctx, collectorEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, reader(exporter))
+	}
+	if otlpFile != "" {
+		w, err := openOtlpFile()
+		if err != nil {
+			return nil, err
+		}
+		exporter, err := stdoutmetric.New(stdoutmetric.WithWriter(w))
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, reader(exporter))
+	}
+
+	provider := sdkmetric.NewMeterProvider(options...)
+	otel.SetMeterProvider(provider)
+
+	return closerFunc(func() error { return provider.Shutdown(ctx) }), nil
+}
+
+func newOtlpMetricExporter(ctx context.Context, endpoint string) (sdkmetric.Exporter, error) {
+	switch otlpProtocol {
+	case otlpGrpc:
+		return otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpoint(endpoint), otlpmetricgrpc.WithInsecure())
+	case otlpHttp:
+		return otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpoint(endpoint), otlpmetrichttp.WithInsecure())
+	}
+	return nil, fmt.Errorf("unknown otlp protocol %s", otlpProtocol)
+}
+
+// otelResource describes this service instance: its name, the pod it runs in
+// (POD_NAME, or the hostname, which is the pod name on Kubernetes) and any
+// attribute set in OTEL_RESOURCE_ATTRIBUTES
+func otelResource(ctx context.Context, serviceName string) (*resource.Resource, error) {
+	hostname, _ := os.Hostname()
+	pod := os.Getenv("POD_NAME")
+	if pod == "" {
+		pod = hostname
+	}
+
+	return resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+		resource.WithAttributes(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceInstanceID(hostname),
+			semconv.K8SPodName(pod),
+		),
+	)
+}
+
+// openOtlpFile opens otlpFile once, spans and metrics are appended to it
+func openOtlpFile() (io.Writer, error) {
+	otlpFileOnce.Do(func() {
+		otlpFileWriter, otlpFileErr = os.OpenFile(otlpFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	})
+	return otlpFileWriter, otlpFileErr
+}
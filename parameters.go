@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	parametersFile  string
+	parametersWatch time.Duration
+)
+
+// Parameters are the a..h, x, y values the CPU load and the memory held derive from.
+// The domain tag gives the valid values of a parameter, exposed as its search space:
+// lower:upper ranges, lower:upper:step discrete ranges and categorical values
+type Parameters struct {
+	X int     `json:"x" yaml:"x" domain:"-3:3:1"`
+	Y int     `json:"y" yaml:"y" domain:"-3:3:1"`
+	A float64 `json:"a" yaml:"a" domain:"-4:4"`
+	B float64 `json:"b" yaml:"b" domain:"-250:250"`
+	C float64 `json:"c" yaml:"c" domain:"-10:10"`
+	// continuous over [1E-5, 1E-1], powers of 10 over [10, 1E5]
+	D float64 `json:"d" yaml:"d" domain:"1e-5:1e-1 10 100 1000 10000 100000"`
+	E float64 `json:"e" yaml:"e" domain:"-2.5:2.5"`
+	F float64 `json:"f" yaml:"f" domain:"-10:-5 5:10"`
+	G float64 `json:"g" yaml:"g" domain:"-3:3"`
+	H float64 `json:"h" yaml:"h" domain:"-25:25"`
+}
+
+// Load returns the CPU load in [0, 1] given by getCpuUsage
+func (p Parameters) Load() float64 {
+	return getCpuUsage(p.X, p.Y, p.A, p.B, p.C, p.D, p.E, p.F, p.G, p.H) / 100
+}
+
+// Memory returns the memory units given by getMemoryUsage
+func (p Parameters) Memory() uint {
+	return getMemoryUsage(p.X, p.Y, p.A, p.B, p.C, p.D, p.E, p.F, p.G, p.H)
+}
+
+// RequestsPerSecond returns the requests per second given by the throughput
+// function, or derived from the CPU load when there is none
+func (p Parameters) RequestsPerSecond() float64 {
+	if rps, ok := requestsPerSecondAt(coordinates(p.X, p.Y, p.A, p.B, p.C, p.D, p.E, p.F, p.G, p.H)); ok {
+		return rps
+	}
+	// 500 -> 10K
+	return p.Load() * 2000
+}
+
+// Latency returns the time added to every message by the latency function
+func (p Parameters) Latency() time.Duration {
+	return latencyAt(coordinates(p.X, p.Y, p.A, p.B, p.C, p.D, p.E, p.F, p.G, p.H))
+}
+
+// parametersState is the tuning state exposed on /admin/parameters
+type parametersState struct {
+	Parameters
+	Load              float64 `json:"load"`
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	LatencySeconds    float64 `json:"latencySeconds"`
+	MemoryUnits       uint    `json:"memoryUnits"`
+}
+
+// loadParameters reads a JSON (.json) or YAML file of parameters; the
+// parameters left out of the file keep their value in current
+func loadParameters(filename string, current Parameters) (Parameters, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return current, err
+	}
+
+	params := current
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		err = json.Unmarshal(data, &params)
+	} else {
+		err = yaml.Unmarshal(data, &params)
+	}
+	if err != nil {
+		return current, fmt.Errorf("parsing parameters %s: %v", filename, err)
+	}
+	return params, nil
+}
+
+// Tuner applies new parameters while the service runs: it recomputes the load
+// and the requests per second of the service, changes the rate of the limiter
+// and grows or shrinks the memory held
+type Tuner struct {
+	mux     sync.Mutex
+	params  Parameters
+	service *Service
+	limiter *RateLimiter
+	memory  *Ballast
+}
+
+func NewTuner(params Parameters, service *Service, limiter *RateLimiter, memory *Ballast) *Tuner {
+	return &Tuner{params: params, service: service, limiter: limiter, memory: memory}
+}
+
+// Parameters returns the parameters currently applied
+func (t *Tuner) Parameters() Parameters {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.params
+}
+
+// Apply makes params the parameters of the service
+func (t *Tuner) Apply(params Parameters) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.params = params
+	t.service.Tune(params)
+	rps, load := t.service.Rates()
+	t.limiter.SetRate(rps)
+	t.memory.SetBase(params.Memory())
+	setParameterMetrics(t.service, params)
+	log.Printf("parameters %+v applied: load: %f, reqps: %f, memory: %d units\n", params, load, rps, t.memory.Units())
+}
+
+func (t *Tuner) state() parametersState {
+	params := t.Parameters()
+	rps, load := t.service.Rates()
+	return parametersState{
+		Parameters:        params,
+		Load:              load,
+		RequestsPerSecond: rps,
+		LatencySeconds:    t.service.AddedLatency().Seconds(),
+		MemoryUnits:       t.memory.Units(),
+	}
+}
+
+// registerAdminParameters adds the tuning parameters API to r:
+//
+//	GET    /admin/parameters               current parameters with the load, requests per second and memory they give
+//	PUT    /admin/parameters               apply new parameters, those left out keep their value
+func registerAdminParameters(r *mux.Router, tuner *Tuner) {
+	r.Methods("GET").Path("/admin/parameters").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, tuner.state())
+	})
+	r.Methods("PUT").Path("/admin/parameters").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := tuner.Parameters()
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tuner.Apply(params)
+		log.Printf("admin: parameters replaced\n")
+		writeJSON(w, http.StatusOK, tuner.state())
+	})
+}
+
+// watchParameters applies filename whenever it changes or the process receives SIGHUP.
+// A file that cannot be parsed is logged and the current parameters are kept
+func watchParameters(filename string, interval time.Duration, tuner *Tuner) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+
+	lastMod := fileModTime(filename)
+	for {
+		select {
+		case <-hup:
+			log.Printf("SIGHUP received, reloading %s\n", filename)
+		case <-tick:
+			modTime := fileModTime(filename)
+			if modTime.Equal(lastMod) {
+				continue
+			}
+			log.Printf("%s changed, reloading\n", filename)
+		}
+		lastMod = fileModTime(filename)
+
+		params, err := loadParameters(filename, tuner.Parameters())
+		if err != nil {
+			log.Printf("keeping current parameters: %v\n", err)
+			continue
+		}
+		tuner.Apply(params)
+	}
+}
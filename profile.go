@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	cpuProfile      string
+	memoryProfile   string
+	profileInterval time.Duration
+	// cpuFactor holds the float64 bits of the factor of the CPU time per message
+	cpuFactor = math.Float64bits(1)
+)
+
+// LoadProfile is a factor that changes over time since the service started
+type LoadProfile interface {
+	Factor(elapsed time.Duration) float64
+	String() string
+}
+
+// newLoadProfile builds a load profile from a spec of the form name[:key=value,...]:
+//
+//	constant                               always 1
+//	step:levels=1/2/4,every=5m             each level for every, then again from the first
+//	ramp:from=1,to=3,duration=10m          from from to to in duration, then to
+//	sine:base=1,amplitude=0.5,period=10m   base + amplitude * sin(2 pi t / period)
+//	spike:factor=3,every=5m,duration=30s   factor during duration at the start of every period, 1 otherwise
+//	replay:file=load.csv                   the factors of "seconds,factor" lines, each until the next one, then again
+//
+// Factors are never negative.
+func newLoadProfile(spec string) (LoadProfile, error) {
+	name, params, err := parseDistributionSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	durations := map[string]time.Duration{}
+	for key, value := range params {
+		switch key {
+		case "every", "duration", "period":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s: %s must be a positive duration", spec, key)
+			}
+			durations[key] = d
+		case "file", "levels":
+		default:
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("%s: %s is not a number", spec, key)
+			}
+		}
+	}
+	duration := func(key string, fallback time.Duration) time.Duration {
+		if d, ok := durations[key]; ok {
+			return d
+		}
+		return fallback
+	}
+
+	base := loadProfile{spec: spec}
+	switch name {
+	case "constant", "":
+		return &stepProfile{loadProfile: base, levels: []float64{1}, every: time.Hour}, nil
+	case "step":
+		levels := []float64{}
+		for _, level := range strings.Split(params["levels"], "/") {
+			value, err := strconv.ParseFloat(strings.TrimSpace(level), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: levels must be numbers separated by /", spec)
+			}
+			levels = append(levels, value)
+		}
+		return &stepProfile{loadProfile: base, levels: levels, every: duration("every", 5*time.Minute)}, nil
+	case "ramp":
+		return &rampProfile{loadProfile: base, from: params.get("from", 1), to: params.get("to", 2), duration: duration("duration", 10*time.Minute)}, nil
+	case "sine":
+		return &sineProfile{loadProfile: base, base: params.get("base", 1), amplitude: params.get("amplitude", 0.5), period: duration("period", 10*time.Minute)}, nil
+	case "spike":
+		every, length := duration("every", 5*time.Minute), duration("duration", 30*time.Second)
+		if length > every {
+			return nil, fmt.Errorf("%s: duration must not exceed every", spec)
+		}
+		return &spikeProfile{loadProfile: base, factor: params.get("factor", 3), every: every, duration: length}, nil
+	case "replay":
+		file, ok := params["file"]
+		if !ok {
+			return nil, fmt.Errorf("%s: missing file", spec)
+		}
+		offsets, factors, err := loadReplay(file)
+		if err != nil {
+			return nil, err
+		}
+		return &replayProfile{loadProfile: base, offsets: offsets, factors: factors}, nil
+	default:
+		return nil, fmt.Errorf("unknown load profile %s", name)
+	}
+}
+
+type loadProfile struct {
+	spec string
+}
+
+func (p *loadProfile) String() string {
+	return p.spec
+}
+
+type stepProfile struct {
+	loadProfile
+	levels []float64
+	every  time.Duration
+}
+
+func (p *stepProfile) Factor(elapsed time.Duration) float64 {
+	return math.Max(0, p.levels[int(elapsed/p.every)%len(p.levels)])
+}
+
+type rampProfile struct {
+	loadProfile
+	from, to float64
+	duration time.Duration
+}
+
+func (p *rampProfile) Factor(elapsed time.Duration) float64 {
+	progress := math.Min(1, float64(elapsed)/float64(p.duration))
+	return math.Max(0, p.from+(p.to-p.from)*progress)
+}
+
+type sineProfile struct {
+	loadProfile
+	base, amplitude float64
+	period          time.Duration
+}
+
+func (p *sineProfile) Factor(elapsed time.Duration) float64 {
+	return math.Max(0, p.base+p.amplitude*math.Sin(2*math.Pi*float64(elapsed)/float64(p.period)))
+}
+
+type spikeProfile struct {
+	loadProfile
+	factor          float64
+	every, duration time.Duration
+}
+
+func (p *spikeProfile) Factor(elapsed time.Duration) float64 {
+	if elapsed%p.every < p.duration {
+		return math.Max(0, p.factor)
+	}
+	return 1
+}
+
+type replayProfile struct {
+	loadProfile
+	offsets []time.Duration
+	factors []float64
+}
+
+func (p *replayProfile) Factor(elapsed time.Duration) float64 {
+	// the trace repeats after its last line; a line at offset 0 is implied with the first factor
+	if last := p.offsets[len(p.offsets)-1]; last > 0 {
+		elapsed %= last
+	}
+	i := sort.Search(len(p.offsets), func(i int) bool { return p.offsets[i] > elapsed })
+	if i > 0 {
+		i--
+	}
+	return math.Max(0, p.factors[i])
+}
+
+// loadReplay reads "seconds,factor" lines, skipping blank lines and # comments,
+// and returns them sorted by offset
+func loadReplay(filename string) ([]time.Duration, []float64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	type sample struct {
+		offset time.Duration
+		factor float64
+	}
+	samples := []sample{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("%s:%d: expected seconds,factor", filename, line)
+		}
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+		if err != nil || seconds < 0 {
+			return nil, nil, fmt.Errorf("%s:%d: invalid offset %s", filename, line, fields[0])
+		}
+		factor, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+		samples = append(samples, sample{offset: time.Duration(seconds * float64(time.Second)), factor: factor})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(samples) == 0 {
+		return nil, nil, fmt.Errorf("%s: empty replay", filename)
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].offset < samples[j].offset })
+	offsets := make([]time.Duration, len(samples))
+	factors := make([]float64, len(samples))
+	for i, s := range samples {
+		offsets[i], factors[i] = s.offset, s.factor
+	}
+	return offsets, factors, nil
+}
+
+// cpuProfileFactor returns the current factor of the CPU time per message
+func cpuProfileFactor() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&cpuFactor))
+}
+
+/**
+* runLoadProfiles applies the load profiles every interval, until the process ends
+* @param cpu the profile of the CPU time per message
+* @param memory the profile of the memory held, as a factor of the units given by getMemoryUsage
+* @param allocation the memory held by the service
+* @param interval the time between two updates
+ */
+func runLoadProfiles(cpu LoadProfile, memory LoadProfile, allocation *Ballast, interval time.Duration) {
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		elapsed := time.Since(start)
+
+		cpuScale := cpu.Factor(elapsed)
+		atomic.StoreUint64(&cpuFactor, math.Float64bits(cpuScale))
+		profileFactorGauge.WithLabelValues("cpu").Set(cpuScale)
+
+		memoryScale := memory.Factor(elapsed)
+		profileFactorGauge.WithLabelValues("memory").Set(memoryScale)
+		held := allocation.Units()
+		allocation.Scale(memoryScale)
+		if units := allocation.Units(); units != held {
+			log.Printf("load profile at %v: cpu x%.2f, memory %d -> %d units\n", elapsed.Round(time.Second), cpuScale, held, units)
+		}
+
+		<-ticker.C
+	}
+}
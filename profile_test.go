@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLoadProfile(t *testing.T) {
+	type point struct {
+		elapsed time.Duration
+		factor  float64
+	}
+	tests := []struct {
+		spec   string
+		points []point
+		err    string
+	}{
+		{spec: "constant", points: []point{{0, 1}, {24 * time.Hour, 1}}},
+		{
+			spec:   "step:levels=1/2/4,every=1m",
+			points: []point{{0, 1}, {59 * time.Second, 1}, {time.Minute, 2}, {2 * time.Minute, 4}, {3 * time.Minute, 1}},
+		},
+		{spec: "step:levels=2/-1,every=1m", points: []point{{0, 2}, {time.Minute, 0}}},
+		{
+			spec:   "ramp:from=1,to=3,duration=10m",
+			points: []point{{0, 1}, {5 * time.Minute, 2}, {10 * time.Minute, 3}, {time.Hour, 3}},
+		},
+		{spec: "ramp:from=2,to=0,duration=1m", points: []point{{30 * time.Second, 1}, {time.Hour, 0}}},
+		{
+			spec:   "sine:base=1,amplitude=0.5,period=4m",
+			points: []point{{0, 1}, {time.Minute, 1.5}, {2 * time.Minute, 1}, {3 * time.Minute, 0.5}, {4 * time.Minute, 1}},
+		},
+		{spec: "sine:base=0,amplitude=1,period=4m", points: []point{{time.Minute, 1}, {3 * time.Minute, 0}}},
+		{
+			spec:   "spike:factor=3,every=5m,duration=30s",
+			points: []point{{0, 3}, {29 * time.Second, 3}, {30 * time.Second, 1}, {5 * time.Minute, 3}, {6 * time.Minute, 1}},
+		},
+		{spec: "step:levels=1/x", err: "levels must be numbers separated by /"},
+		{spec: "step:every=0s", err: "every must be a positive duration"},
+		{spec: "ramp:from=low", err: "from is not a number"},
+		{spec: "sine:period=-1m", err: "period must be a positive duration"},
+		{spec: "spike:every=30s,duration=1m", err: "duration must not exceed every"},
+		{spec: "replay", err: "missing file"},
+		{spec: "replay:file=/nonexistent/load.csv", err: "no such file"},
+		{spec: "square", err: "unknown load profile square"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			profile, err := newLoadProfile(test.spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("newLoadProfile(%s) error = %v, want %q", test.spec, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newLoadProfile(%s) error = %v", test.spec, err)
+			}
+			if profile.String() != test.spec {
+				t.Errorf("String() = %s, want %s", profile.String(), test.spec)
+			}
+			for _, point := range test.points {
+				if factor := profile.Factor(point.elapsed); math.Abs(factor-point.factor) > 1e-9 {
+					t.Errorf("Factor(%v) = %g, want %g", point.elapsed, factor, point.factor)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		offsets []time.Duration
+		factors []float64
+		err     string
+	}{
+		{
+			name:    "sorted by offset",
+			content: "# seconds,factor\n60,2\n0,1\n\n 90.5 , 0.5 \n",
+			offsets: []time.Duration{0, time.Minute, 90*time.Second + 500*time.Millisecond},
+			factors: []float64{1, 2, 0.5},
+		},
+		{name: "missing factor", content: "0,1\n60\n", err: "load.csv:2: expected seconds,factor"},
+		{name: "negative offset", content: "-1,1\n", err: "load.csv:1: invalid offset -1"},
+		{name: "factor not a number", content: "0,high\n", err: "load.csv:1:"},
+		{name: "empty file", content: "# nothing\n", err: "empty replay"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "load.csv")
+			if err := os.WriteFile(filename, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			offsets, factors, err := loadReplay(filename)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("loadReplay() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadReplay() error = %v", err)
+			}
+			if !reflect.DeepEqual(offsets, test.offsets) || !reflect.DeepEqual(factors, test.factors) {
+				t.Errorf("loadReplay() = %v, %v, want %v, %v", offsets, factors, test.offsets, test.factors)
+			}
+		})
+	}
+}
+
+func TestReplayProfile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "load.csv")
+	// no line at 0: the first factor holds until the second line
+	if err := os.WriteFile(filename, []byte("10,2\n30,4\n60,-1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profile, err := newLoadProfile("replay:file=" + filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		elapsed time.Duration
+		factor  float64
+	}{
+		{elapsed: 0, factor: 2},
+		{elapsed: 15 * time.Second, factor: 2},
+		{elapsed: 30 * time.Second, factor: 4},
+		{elapsed: 59 * time.Second, factor: 4},
+		// the trace starts again after its last line
+		{elapsed: 60 * time.Second, factor: 2},
+		{elapsed: 95 * time.Second, factor: 4},
+	}
+	for _, test := range tests {
+		if factor := profile.Factor(test.elapsed); factor != test.factor {
+			t.Errorf("Factor(%v) = %g, want %g", test.elapsed, factor, test.factor)
+		}
+	}
+}
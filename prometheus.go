@@ -0,0 +1,315 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "microservice"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests served, by endpoint and HTTP status code.",
+	}, []string{"endpoint", "code"})
+	requestErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_errors_total",
+		Help:      "Requests answered with a 5xx status code or aborted without an answer, by endpoint.",
+	}, []string{"endpoint"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time to serve a request, by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"endpoint"})
+
+	downstreamRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downstream_requests_total",
+		Help:      "Calls to downstream services, by target, endpoint and HTTP status code (error if no response).",
+	}, []string{"target", "endpoint", "code"})
+	downstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downstream_errors_total",
+		Help:      "Calls to downstream services without a 200 response, by target and endpoint.",
+	}, []string{"target", "endpoint"})
+	downstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "downstream_duration_seconds",
+		Help:      "Time to get a response from a downstream service, by target and endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"target", "endpoint"})
+	downstreamRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downstream_retries_total",
+		Help:      "Calls to downstream services that were retries, by target and endpoint.",
+	}, []string{"target", "endpoint"})
+	retryBudgetExhaustedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retry_budget_exhausted_total",
+		Help:      "Failed calls not retried because the retry budget was spent, by target and endpoint.",
+	}, []string{"target", "endpoint"})
+	hedgesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hedges_total",
+		Help:      "Duplicate calls sent to downstream services after the hedge delay, by target and endpoint.",
+	}, []string{"target", "endpoint"})
+	hedgeWinsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "hedge_wins_total",
+		Help:      "Duplicate calls that answered first, by target and endpoint.",
+	}, []string{"target", "endpoint"})
+	faultsInjectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "faults_injected_total",
+		Help:      "Faults injected into requests, by endpoint and fault type.",
+	}, []string{"endpoint", "type"})
+
+	parameterGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "parameter",
+		Help:      "Configured load parameters (a..h, x, y, msg_size, msg_time).",
+	}, []string{"name"})
+	requestsPerSecondGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_per_second",
+		Help:      "Requests per second allowed by the service rate limit.",
+	})
+	loadGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "load",
+		Help:      "CPU load in [0, 1] derived from the parameters.",
+	})
+	profileFactorGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "profile_factor",
+		Help:      "Current factor of the load profiles, by resource (cpu, memory).",
+	}, []string{"resource"})
+)
+
+// registerMetrics registers the service metrics and adds the /metrics endpoint to r.
+// The limiter and queue counters are read on every scrape; queue may be nil.
+func registerMetrics(r *mux.Router, limiter *RateLimiter, queue *WorkQueue, ballast *Ballast) {
+	prometheus.MustRegister(
+		requestsTotal, requestErrorsTotal, requestDuration,
+		downstreamRequestsTotal, downstreamErrorsTotal, downstreamDuration,
+		downstreamRetriesTotal, retryBudgetExhaustedTotal, hedgesTotal, hedgeWinsTotal,
+		faultsInjectedTotal,
+		parameterGauge, requestsPerSecondGauge, loadGauge, profileFactorGauge,
+		&limiterCollector{limiter: limiter},
+		&breakerCollector{},
+		&ballastCollector{ballast: ballast},
+	)
+	if queue != nil {
+		prometheus.MustRegister(&queueCollector{queue: queue})
+	}
+
+	r.Methods("GET").Path("/metrics").Handler(promhttp.Handler())
+}
+
+// setParameterMetrics publishes the current load parameters
+func setParameterMetrics(service *Service, parameters Parameters) {
+	for _, definition := range parameterSpaces {
+		parameterGauge.WithLabelValues(definition.Name).Set(definition.value(parameters))
+	}
+	parameterGauge.WithLabelValues("msg_size").Set(float64(msgSize))
+	parameterGauge.WithLabelValues("msg_time").Set(float64(msgTime))
+	rps, load := service.Rates()
+	requestsPerSecondGauge.Set(rps)
+	loadGauge.Set(load)
+}
+
+// endpointLabel returns the endpoint name of path for metrics: the fixed
+// endpoints, the path ids currently served, or "other"
+func endpointLabel(paths *PathRoutes, path string) string {
+	switch path {
+	case "all", "random", "health":
+		return path
+	}
+	if _, ok := paths.Topology().Paths[path]; ok {
+		return path
+	}
+	return "other"
+}
+
+// instrument records the RED metrics of the requests to next.
+// endpoint maps a request path to its endpoint label, so unknown paths do not
+// create new series.
+func instrument(next http.Handler, endpoint func(path string) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r)
+
+		label := endpoint(strings.TrimPrefix(r.URL.Path, "/"))
+		requestsTotal.WithLabelValues(label, recorder.code()).Inc()
+		if recorder.status >= 500 || recorder.status == 0 {
+			requestErrorsTotal.WithLabelValues(label).Inc()
+		}
+		requestDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observeDownstream records a call to target; code is 0 if no response was received
+func observeDownstream(target string, endpoint string, code int, elapsed time.Duration) {
+	label := "error"
+	if code > 0 {
+		label = strconv.Itoa(code)
+	}
+	downstreamRequestsTotal.WithLabelValues(target, endpoint, label).Inc()
+	if code != http.StatusOK {
+		downstreamErrorsTotal.WithLabelValues(target, endpoint).Inc()
+	}
+	downstreamDuration.WithLabelValues(target, endpoint).Observe(elapsed.Seconds())
+}
+
+// statusRecorder remembers the status code written to a ResponseWriter,
+// 0 while nothing was written, e.g. when the connection was hijacked or reset
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write answers 200 if no status was written before, as http.ResponseWriter does
+func (s *statusRecorder) Write(body []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(body)
+}
+
+// code returns the status code label of the request, aborted if nothing was written
+func (s *statusRecorder) code() string {
+	if s.status == 0 {
+		return "aborted"
+	}
+	return strconv.Itoa(s.status)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to hijack it
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+var (
+	queueDepthDesc    = prometheus.NewDesc(metricsNamespace+"_queue_depth", "Requests waiting for a worker.", nil, nil)
+	queueBlockedDesc  = prometheus.NewDesc(metricsNamespace+"_queue_blocked", "Requests waiting for room in the queue.", nil, nil)
+	queueServedDesc   = prometheus.NewDesc(metricsNamespace+"_queue_served_total", "Requests that went through the queue.", nil, nil)
+	queueRejectedDesc = prometheus.NewDesc(metricsNamespace+"_queue_rejected_total", "Requests rejected because the queue was full.", nil, nil)
+	queueWaitDesc     = prometheus.NewDesc(metricsNamespace+"_queue_wait_seconds_total", "Time requests spent waiting for a worker.", nil, nil)
+	queueWorkersDesc  = prometheus.NewDesc(metricsNamespace+"_queue_workers", "Requests served at the same time.", nil, nil)
+)
+
+// queueCollector exports the WorkQueue counters
+type queueCollector struct {
+	queue *WorkQueue
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- queueBlockedDesc
+	ch <- queueServedDesc
+	ch <- queueRejectedDesc
+	ch <- queueWaitDesc
+	ch <- queueWorkersDesc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.queue.Stats()
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(stats.Depth))
+	ch <- prometheus.MustNewConstMetric(queueBlockedDesc, prometheus.GaugeValue, float64(stats.Waiting))
+	ch <- prometheus.MustNewConstMetric(queueServedDesc, prometheus.CounterValue, float64(stats.Served))
+	ch <- prometheus.MustNewConstMetric(queueRejectedDesc, prometheus.CounterValue, float64(stats.Rejected))
+	ch <- prometheus.MustNewConstMetric(queueWaitDesc, prometheus.CounterValue, stats.WaitSeconds)
+	ch <- prometheus.MustNewConstMetric(queueWorkersDesc, prometheus.GaugeValue, float64(stats.Workers))
+}
+
+var (
+	ballastBytesDesc = prometheus.NewDesc(metricsNamespace+"_memory_ballast_bytes",
+		"Bytes of memory held to follow the memory target.", nil, nil)
+	ballastChurnedDesc = prometheus.NewDesc(metricsNamespace+"_memory_churned_bytes_total",
+		"Bytes of ballast replaced to put the GC under pressure.", nil, nil)
+)
+
+// ballastCollector exports the size of the Ballast
+type ballastCollector struct {
+	ballast *Ballast
+}
+
+func (c *ballastCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ballastBytesDesc
+	ch <- ballastChurnedDesc
+}
+
+func (c *ballastCollector) Collect(ch chan<- prometheus.Metric) {
+	units := c.ballast.Units()
+	ch <- prometheus.MustNewConstMetric(ballastBytesDesc, prometheus.GaugeValue, float64(uint64(units)*uint64(epsilon)*1024*1024))
+	ch <- prometheus.MustNewConstMetric(ballastChurnedDesc, prometheus.CounterValue, float64(c.ballast.Churned()))
+}
+
+var rateLimitDesc = prometheus.NewDesc(metricsNamespace+"_ratelimit_requests_total",
+	"Requests through the rate limiter, by endpoint, limit that throttled them and outcome.",
+	[]string{"endpoint", "scope", "outcome"}, nil)
+
+// limiterCollector exports the RateLimiter counters
+type limiterCollector struct {
+	limiter *RateLimiter
+}
+
+func (c *limiterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rateLimitDesc
+}
+
+func (c *limiterCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stats := range c.limiter.Stats() {
+		ch <- prometheus.MustNewConstMetric(rateLimitDesc, prometheus.CounterValue, float64(stats.Requests), stats.Endpoint, stats.Scope, stats.Outcome)
+	}
+}
+
+var (
+	breakerStateDesc = prometheus.NewDesc(metricsNamespace+"_breaker_state",
+		"Circuit breaker state per downstream target, 1 for the current state.", []string{"target", "state"}, nil)
+	breakerOpenedDesc = prometheus.NewDesc(metricsNamespace+"_breaker_opened_total",
+		"Times the circuit breaker of a downstream target opened.", []string{"target"}, nil)
+	breakerRejectedDesc = prometheus.NewDesc(metricsNamespace+"_breaker_rejected_total",
+		"Calls to a downstream target answered by the fallback of its circuit breaker.", []string{"target"}, nil)
+)
+
+// breakerCollector exports the CircuitBreaker states and counters
+type breakerCollector struct{}
+
+func (c *breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerStateDesc
+	ch <- breakerOpenedDesc
+	ch <- breakerRejectedDesc
+}
+
+func (c *breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stats := range breakerStats() {
+		for _, state := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+			value := 0.0
+			if stats.State == state {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(breakerStateDesc, prometheus.GaugeValue, value, stats.Target, state)
+		}
+		ch <- prometheus.MustNewConstMetric(breakerOpenedDesc, prometheus.CounterValue, float64(stats.Opened), stats.Target)
+		ch <- prometheus.MustNewConstMetric(breakerRejectedDesc, prometheus.CounterValue, float64(stats.Rejected), stats.Target)
+	}
+}
@@ -2,89 +2,131 @@ package main
 
 import (
 	"log"
-	"sync"
+	"net/http"
+	"sync/atomic"
+	"time"
 )
 
-// Create basic structure of a Request
+const (
+	queueBlock  = "block"
+	queueReject = "reject"
+)
+
+// Create a WorkQueue structure that serves requests with a fixed pool of workers
 // Contains the following information:
-// Value: Contains the Address of where the request is coming from
-type Request struct {
-	Value string
+// jobs: Stores the requests waiting for a worker, its capacity is the queue depth
+// workers: Stores the number of requests served at the same time
+// reject: Whether a request arriving to a full queue is rejected with 503 instead of waiting
+// waiting: Stores the number of requests blocked waiting for room in the queue
+// rejected: Stores the number of requests rejected because the queue was full
+// served: Stores the number of requests that went through the queue
+// waitTime: Stores the total time (ns) requests spent in the queue
+type WorkQueue struct {
+	jobs     chan *job
+	workers  int
+	reject   bool
+	waiting  int64
+	rejected uint64
+	served   uint64
+	waitTime int64
 }
 
-/**
-* NewQueue returns a new queue with the size passed through param
-* @param size the size to intilialize this queue
-* @return *Queue a new Queue structure with the provided size
-**/
-func NewQueue(size int) *Queue {
-	log.Printf("creating queue of size %d\n", size)
-	return &Queue{
-		requests: make([]*Request, size),
-		size:     size,
-		head:     0,
-		tail:     0,
-		count:    0,
-	}
+// job is a request waiting in the queue; done is closed once it has been served
+type job struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	next     http.Handler
+	enqueued time.Time
+	done     chan struct{}
 }
 
-// Create a Queue structure that is FIFO data structure
-// Contains the following information:
-// size: Stores the size of the Queue
-// head: Stores the location of the front of the Queue
-// tail: Stores the location of the back of the Queue
-// count: Stores the number of Requests within the Queue
-// muxForPush: Provides lock/unlock functionality for Push since this Queue will be accessed by multiple threads (we don't want several threads modifying variables at the same time)
-// muxForPop: Provides lock/unlock functionality for Pop since this Queue will be accessed by multiple threads (we don't want several threads modifying variables at the same time)
-type Queue struct {
-	requests   []*Request
-	size       int
-	head       int
-	tail       int
-	count      int
-	muxForPush sync.Mutex
-	muxForPop  sync.Mutex
+// QueueStats is a snapshot of the queue counters
+type QueueStats struct {
+	Workers         int     `json:"workers"`
+	Capacity        int     `json:"capacity"`
+	Depth           int     `json:"depth"`
+	Waiting         int64   `json:"waiting"`
+	Served          uint64  `json:"served"`
+	Rejected        uint64  `json:"rejected"`
+	WaitSeconds     float64 `json:"waitSeconds"`
+	MeanWaitSeconds float64 `json:"meanWaitSeconds"`
 }
 
 /**
-* Push a Request onto the Queue
-* @param Request the new request that will be pushed onto the Queue
-* if the Queue is full, then function will halt until it becomes empty
+* NewWorkQueue returns a queue served by workers goroutines
+* @param workers the number of requests served at the same time
+* @param depth the number of requests that can wait for a worker
+* @param overflow what happens to a request arriving to a full queue: block or reject
+* @return *WorkQueue a new WorkQueue with its workers running
 **/
-func (q *Queue) Push(n *Request) {
-
-	//various threads can access these values, so perform lock functionality here
-	// Lock so only one goroutine at a time can access these variables
-	q.muxForPush.Lock()
-	if q.size <= q.count {
-		for q.count > 0 {
-			//log.Printf("======== QUEUE is full.... ==========")
-		}
+func NewWorkQueue(workers int, depth int, overflow string) *WorkQueue {
+	log.Printf("creating queue with %d workers, depth %d, %s on overflow\n", workers, depth, overflow)
+	q := &WorkQueue{
+		jobs:    make(chan *job, depth),
+		workers: workers,
+		reject:  overflow == queueReject,
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
 	}
+	return q
+}
+
+// Handler queues every request to next until a worker is free to serve it
+func (q *WorkQueue) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j := &job{w: w, r: r, next: next, enqueued: time.Now(), done: make(chan struct{})}
 
-	q.requests[q.tail] = n
-	q.tail = (q.tail + 1) % len(q.requests)
-	q.count++
-	q.muxForPush.Unlock()
+		if q.reject {
+			select {
+			case q.jobs <- j:
+			default:
+				atomic.AddUint64(&q.rejected, 1)
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+		} else {
+			atomic.AddInt64(&q.waiting, 1)
+			select {
+			case q.jobs <- j:
+				atomic.AddInt64(&q.waiting, -1)
+			case <-r.Context().Done():
+				atomic.AddInt64(&q.waiting, -1)
+				return
+			}
+		}
 
+		// the worker writes the response, so w must stay valid until it is done
+		<-j.done
+	})
 }
 
-/**
-* Pop a Request from the Queue
-* @return request the Request that has been popped from the Queue
-**/
-func (q *Queue) Pop() *Request {
+func (q *WorkQueue) work() {
+	for j := range q.jobs {
+		atomic.AddInt64(&q.waitTime, int64(time.Since(j.enqueued)))
+		atomic.AddUint64(&q.served, 1)
 
-	//various threads can access these values, so perform lock functionality here
-	// Lock so only one goroutine at a time can access these variables
-	q.muxForPop.Lock()
-	if q.count == 0 {
-		return nil
+		// the client gave up while waiting, do not spend a worker on it
+		if j.r.Context().Err() == nil {
+			j.next.ServeHTTP(j.w, j.r)
+		}
+		close(j.done)
 	}
-	request := q.requests[q.head]
-	q.head = (q.head + 1) % len(q.requests)
-	q.count--
-	q.muxForPop.Unlock()
+}
 
-	return request
+// Stats returns a snapshot of the queue counters
+func (q *WorkQueue) Stats() QueueStats {
+	stats := QueueStats{
+		Workers:     q.workers,
+		Capacity:    cap(q.jobs),
+		Depth:       len(q.jobs),
+		Waiting:     atomic.LoadInt64(&q.waiting),
+		Served:      atomic.LoadUint64(&q.served),
+		Rejected:    atomic.LoadUint64(&q.rejected),
+		WaitSeconds: time.Duration(atomic.LoadInt64(&q.waitTime)).Seconds(),
+	}
+	if stats.Served > 0 {
+		stats.MeanWaitSeconds = stats.WaitSeconds / float64(stats.Served)
+	}
+	return stats
 }
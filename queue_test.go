@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingHandler answers 200 once release is closed, and signals started on every request
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestWorkQueueServes(t *testing.T) {
+	var served int32
+	queue := NewWorkQueue(2, 4, queueBlock)
+	handler := queue.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/0", nil))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("request %d: status = %d, want %d", i, w.Code, http.StatusAccepted)
+		}
+	}
+
+	stats := queue.Stats()
+	if served != 5 || stats.Served != 5 || stats.Rejected != 0 {
+		t.Errorf("served %d, stats %+v, want 5 served and none rejected", served, stats)
+	}
+	if stats.Workers != 2 || stats.Capacity != 4 || stats.Depth != 0 || stats.Waiting != 0 {
+		t.Errorf("stats = %+v, want 2 workers, capacity 4 and an empty queue", stats)
+	}
+}
+
+func TestWorkQueueOverflow(t *testing.T) {
+	tests := []struct {
+		overflow string
+		// status is the answer to the request arriving to the full queue, 0 if it is still waiting
+		status   int
+		rejected uint64
+		waiting  int64
+	}{
+		{overflow: queueReject, status: http.StatusServiceUnavailable, rejected: 1},
+		{overflow: queueBlock, status: 0, waiting: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.overflow, func(t *testing.T) {
+			started := make(chan struct{}, 3)
+			release := make(chan struct{})
+			// one worker and room for one more: the third request finds the queue full
+			queue := NewWorkQueue(1, 1, test.overflow)
+			handler := queue.Handler(blockingHandler(started, release))
+
+			served := make(chan int, 2)
+			serve := func() {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("POST", "/0", nil))
+				served <- w.Code
+			}
+			go serve()
+			<-started
+			go serve()
+			for deadline := time.Now().Add(time.Second); queue.Stats().Depth == 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			overflowing := make(chan int)
+			go func() {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("POST", "/0", nil).WithContext(ctx))
+				overflowing <- w.Code
+			}()
+
+			if test.status != 0 {
+				if status := <-overflowing; status != test.status {
+					t.Errorf("status of the overflowing request = %d, want %d", status, test.status)
+				}
+			} else {
+				// the request blocks until the client gives up
+				for deadline := time.Now().Add(time.Second); queue.Stats().Waiting == 0 && time.Now().Before(deadline); {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			stats := queue.Stats()
+			if stats.Rejected != test.rejected || stats.Waiting != test.waiting {
+				t.Errorf("stats = %+v, want %d rejected and %d waiting", stats, test.rejected, test.waiting)
+			}
+
+			cancel()
+			if test.status == 0 {
+				<-overflowing
+				if waiting := queue.Stats().Waiting; waiting != 0 {
+					t.Errorf("%d requests still waiting after the client went away", waiting)
+				}
+			}
+			close(release)
+			for i := 0; i < 2; i++ {
+				if status := <-served; status != http.StatusOK {
+					t.Errorf("status of a queued request = %d, want %d", status, http.StatusOK)
+				}
+			}
+			if served := queue.Stats().Served; served != 2 {
+				t.Errorf("served = %d, want 2", served)
+			}
+		})
+	}
+}
+
+func TestWorkQueueSkipsAbandonedRequests(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	queue := NewWorkQueue(1, 1, queueBlock)
+	handler := queue.Handler(blockingHandler(started, release))
+
+	first := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/0", nil))
+		close(first)
+	}()
+	<-started
+
+	// the second request waits in the queue and its client goes away before a worker is free
+	ctx, cancel := context.WithCancel(context.Background())
+	second := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/0", nil).WithContext(ctx))
+		close(second)
+	}()
+	for deadline := time.Now().Add(time.Second); queue.Stats().Depth == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	close(release)
+	<-first
+	<-second
+
+	select {
+	case <-started:
+		t.Error("a worker served a request abandoned by its client")
+	default:
+	}
+	if served := queue.Stats().Served; served != 2 {
+		t.Errorf("served = %d, want 2", served)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	limitWait   = "wait"
+	limitReject = "reject"
+	limitShed   = "shed"
+
+	// idle client limiters are forgotten after clientIdleTime
+	clientIdleTime = time.Minute
+)
+
+// RateLimiter throttles requests with token buckets: one for the service,
+// one per configured endpoint and, optionally, one per client IP.
+// A request over the limit waits for a token, is rejected with 429 and
+// Retry-After, or is shed with 503, depending on the mode.
+type RateLimiter struct {
+	label     func(path string) string
+	mode      string
+	burst     int
+	global    *rate.Limiter
+	endpoints map[string]*rate.Limiter
+
+	clientRate rate.Limit
+	clientMux  sync.Mutex
+	clients    map[string]*clientLimiter
+
+	statsMux sync.Mutex
+	stats    map[limitKey]uint64
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limitKey counts requests per endpoint, limit that throttled them and outcome
+type limitKey struct {
+	endpoint string
+	scope    string
+	outcome  string
+}
+
+// LimitStats is a counter of requests for an endpoint, limit scope and outcome
+type LimitStats struct {
+	Endpoint string `json:"endpoint"`
+	Scope    string `json:"scope,omitempty"`
+	Outcome  string `json:"outcome"`
+	Requests uint64 `json:"requests"`
+}
+
+/**
+* NewRateLimiter returns a limiter for the whole service
+* @param rps the requests per second of the service, 0 or less (or NaN) means no limit
+* @param burst the number of requests allowed above the rate at once
+* @param mode what happens to a request over the limit: wait, reject or shed
+* @param endpointLimits requests per second of endpoints with their own limit
+* @param clientRps requests per second of each client IP, 0 means no limit
+* @param label maps a request path to the endpoint name used in the counters
+**/
+func NewRateLimiter(rps float64, burst int, mode string, endpointLimits limitFlag, clientRps float64, label func(path string) string) *RateLimiter {
+	l := &RateLimiter{
+		label:      label,
+		mode:       mode,
+		burst:      burst,
+		global:     rate.NewLimiter(toLimit(rps), burst),
+		endpoints:  make(map[string]*rate.Limiter, len(endpointLimits)),
+		clientRate: toLimit(clientRps),
+		clients:    map[string]*clientLimiter{},
+		stats:      map[limitKey]uint64{},
+	}
+	for endpoint, endpointRps := range endpointLimits {
+		l.endpoints[endpoint] = rate.NewLimiter(toLimit(endpointRps), burst)
+	}
+	if clientRps > 0 {
+		go l.forgetIdleClients()
+	}
+	return l
+}
+
+func toLimit(rps float64) rate.Limit {
+	if math.IsNaN(rps) || rps <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(rps)
+}
+
+// SetRate changes the requests per second of the service, 0 or less (or NaN) means no limit
+func (l *RateLimiter) SetRate(rps float64) {
+	l.global.SetLimit(toLimit(rps))
+}
+
+// Handler throttles the requests to next
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := strings.TrimPrefix(r.URL.Path, "/")
+		limiters, scopes := l.limitersFor(endpoint, r)
+		endpoint = l.label(endpoint)
+
+		if l.mode == limitWait {
+			for i, limiter := range limiters {
+				if limiter.Allow() {
+					continue
+				}
+				l.count(endpoint, scopes[i], "delayed")
+				if err := limiter.Wait(r.Context()); err != nil {
+					// the client went away or its deadline is shorter than the wait
+					l.count(endpoint, scopes[i], "cancelled")
+					http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+					return
+				}
+			}
+			l.count(endpoint, "", "allowed")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		reservations := make([]*rate.Reservation, 0, len(limiters))
+		var delay time.Duration
+		scope := ""
+		for i, limiter := range limiters {
+			reservation := limiter.ReserveN(now, 1)
+			reservations = append(reservations, reservation)
+			if !reservation.OK() {
+				delay, scope = time.Second, scopes[i]
+				break
+			}
+			if d := reservation.DelayFrom(now); d > delay {
+				delay, scope = d, scopes[i]
+			}
+		}
+
+		if delay > 0 {
+			for _, reservation := range reservations {
+				reservation.CancelAt(now)
+			}
+			if l.mode == limitShed {
+				l.count(endpoint, scope, "shed")
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			l.count(endpoint, scope, "rejected")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		l.count(endpoint, "", "allowed")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitersFor returns the limiters a request must pass, from the narrowest to the widest
+func (l *RateLimiter) limitersFor(endpoint string, r *http.Request) ([]*rate.Limiter, []string) {
+	limiters := make([]*rate.Limiter, 0, 3)
+	scopes := make([]string, 0, 3)
+
+	if l.clientRate != rate.Inf {
+		limiters = append(limiters, l.clientLimiter(clientIP(r)))
+		scopes = append(scopes, "client")
+	}
+	if limiter, ok := l.endpoints[endpoint]; ok {
+		limiters = append(limiters, limiter)
+		scopes = append(scopes, "endpoint")
+	}
+	limiters = append(limiters, l.global)
+	scopes = append(scopes, "service")
+	return limiters, scopes
+}
+
+func (l *RateLimiter) clientLimiter(ip string) *rate.Limiter {
+	l.clientMux.Lock()
+	defer l.clientMux.Unlock()
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.clientRate, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = time.Now()
+	return client.limiter
+}
+
+func (l *RateLimiter) forgetIdleClients() {
+	for range time.Tick(clientIdleTime) {
+		l.clientMux.Lock()
+		for ip, client := range l.clients {
+			if time.Since(client.lastSeen) > clientIdleTime {
+				delete(l.clients, ip)
+			}
+		}
+		l.clientMux.Unlock()
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (l *RateLimiter) count(endpoint string, scope string, outcome string) {
+	l.statsMux.Lock()
+	l.stats[limitKey{endpoint: endpoint, scope: scope, outcome: outcome}]++
+	l.statsMux.Unlock()
+}
+
+// Stats returns the request counters sorted by endpoint, scope and outcome
+func (l *RateLimiter) Stats() []LimitStats {
+	l.statsMux.Lock()
+	stats := make([]LimitStats, 0, len(l.stats))
+	for key, requests := range l.stats {
+		stats = append(stats, LimitStats{Endpoint: key.endpoint, Scope: key.scope, Outcome: key.outcome, Requests: requests})
+	}
+	l.statsMux.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Endpoint != stats[j].Endpoint {
+			return stats[i].Endpoint < stats[j].Endpoint
+		}
+		if stats[i].Scope != stats[j].Scope {
+			return stats[i].Scope < stats[j].Scope
+		}
+		return stats[i].Outcome < stats[j].Outcome
+	})
+	return stats
+}
+
+// limitFlag collects per endpoint limits given as /endpoint=rps
+type limitFlag map[string]float64
+
+func (f limitFlag) String() string {
+	limits := make([]string, 0, len(f))
+	for endpoint, rps := range f {
+		limits = append(limits, fmt.Sprintf("/%s=%g", endpoint, rps))
+	}
+	sort.Strings(limits)
+	return strings.Join(limits, " ")
+}
+
+func (f limitFlag) Set(value string) error {
+	kv := strings.SplitN(strings.TrimPrefix(value, "/"), "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected /endpoint=rps")
+	}
+	rps, err := strconv.ParseFloat(kv[1], 64)
+	if err != nil {
+		return err
+	}
+	f[kv[0]] = rps
+	return nil
+}
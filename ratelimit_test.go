@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+// pathLabel counts requests under their own path
+func pathLabel(path string) string {
+	return path
+}
+
+// limitedRequest serves a request to endpoint from the client at remoteAddr
+func limitedRequest(handler http.Handler, endpoint string, remoteAddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/"+endpoint, nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimiter(t *testing.T) {
+	type request struct {
+		endpoint string
+		client   string
+		status   int
+	}
+	tests := []struct {
+		name      string
+		rps       float64
+		mode      string
+		endpoints limitFlag
+		clientRps float64
+		requests  []request
+		stats     []LimitStats
+	}{
+		{
+			name: "no limit",
+			rps:  0,
+			mode: limitReject,
+			requests: []request{
+				{endpoint: "0", status: http.StatusOK},
+				{endpoint: "0", status: http.StatusOK},
+				{endpoint: "0", status: http.StatusOK},
+			},
+			stats: []LimitStats{{Endpoint: "0", Outcome: "allowed", Requests: 3}},
+		},
+		{
+			name: "NaN is no limit",
+			rps:  math.NaN(),
+			mode: limitReject,
+			requests: []request{
+				{endpoint: "0", status: http.StatusOK},
+				{endpoint: "0", status: http.StatusOK},
+			},
+			stats: []LimitStats{{Endpoint: "0", Outcome: "allowed", Requests: 2}},
+		},
+		{
+			name: "service limit rejected with 429",
+			rps:  0.001,
+			mode: limitReject,
+			requests: []request{
+				{endpoint: "0", status: http.StatusOK},
+				{endpoint: "1", status: http.StatusTooManyRequests},
+			},
+			stats: []LimitStats{
+				{Endpoint: "0", Outcome: "allowed", Requests: 1},
+				{Endpoint: "1", Scope: "service", Outcome: "rejected", Requests: 1},
+			},
+		},
+		{
+			name: "service limit shed with 503",
+			rps:  0.001,
+			mode: limitShed,
+			requests: []request{
+				{endpoint: "0", status: http.StatusOK},
+				{endpoint: "0", status: http.StatusServiceUnavailable},
+			},
+			stats: []LimitStats{
+				{Endpoint: "0", Outcome: "allowed", Requests: 1},
+				{Endpoint: "0", Scope: "service", Outcome: "shed", Requests: 1},
+			},
+		},
+		{
+			name:      "endpoint limit throttles only its endpoint",
+			rps:       0,
+			mode:      limitReject,
+			endpoints: limitFlag{"0": 0.001},
+			requests: []request{
+				{endpoint: "0", status: http.StatusOK},
+				{endpoint: "0", status: http.StatusTooManyRequests},
+				{endpoint: "1", status: http.StatusOK},
+				{endpoint: "1", status: http.StatusOK},
+			},
+			stats: []LimitStats{
+				{Endpoint: "0", Outcome: "allowed", Requests: 1},
+				{Endpoint: "0", Scope: "endpoint", Outcome: "rejected", Requests: 1},
+				{Endpoint: "1", Outcome: "allowed", Requests: 2},
+			},
+		},
+		{
+			name:      "client limit throttles only its client",
+			rps:       0,
+			mode:      limitReject,
+			clientRps: 0.001,
+			requests: []request{
+				{endpoint: "0", client: "10.0.0.1:1234", status: http.StatusOK},
+				{endpoint: "0", client: "10.0.0.1:5678", status: http.StatusTooManyRequests},
+				{endpoint: "0", client: "10.0.0.2:1234", status: http.StatusOK},
+			},
+			stats: []LimitStats{
+				{Endpoint: "0", Outcome: "allowed", Requests: 2},
+				{Endpoint: "0", Scope: "client", Outcome: "rejected", Requests: 1},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewRateLimiter(test.rps, 1, test.mode, test.endpoints, test.clientRps, pathLabel)
+			handler := limiter.Handler(okHandler)
+			for i, request := range test.requests {
+				client := request.client
+				if client == "" {
+					client = "10.0.0.1:1234"
+				}
+				w := limitedRequest(handler, request.endpoint, client)
+				if w.Code != request.status {
+					t.Fatalf("request %d to /%s: status = %d, want %d", i, request.endpoint, w.Code, request.status)
+				}
+				if retryAfter := w.Header().Get("Retry-After"); (w.Code == http.StatusTooManyRequests) != (retryAfter != "") {
+					t.Errorf("request %d to /%s: status %d with Retry-After %q", i, request.endpoint, w.Code, retryAfter)
+				}
+			}
+			if stats := limiter.Stats(); !reflect.DeepEqual(stats, test.stats) {
+				t.Errorf("Stats() = %+v, want %+v", stats, test.stats)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRejectedRequestKeepsNoToken(t *testing.T) {
+	// the endpoint has room, the service does not: the endpoint token must be given back
+	limiter := NewRateLimiter(0.001, 1, limitReject, limitFlag{"0": 0.001}, 0, pathLabel)
+	handler := limiter.Handler(okHandler)
+
+	if w := limitedRequest(handler, "1", "10.0.0.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := limitedRequest(handler, "0", "10.0.0.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if !limiter.endpoints["0"].Allow() {
+		t.Error("the endpoint limit kept the token of a rejected request")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := NewRateLimiter(20, 1, limitWait, nil, 0, pathLabel)
+	handler := limiter.Handler(okHandler)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if w := limitedRequest(handler, "0", "10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+	// the first request takes the burst, the other two wait 50ms each
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("3 requests at 20 rps took %s, want about 100ms", elapsed)
+	}
+
+	// a client that cannot wait that long is answered 503
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	limiter = NewRateLimiter(0.001, 1, limitWait, nil, 0, pathLabel)
+	handler = limiter.Handler(okHandler)
+	limitedRequest(handler, "0", "10.0.0.1:1234")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/0", nil).WithContext(ctx))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	want := []LimitStats{
+		{Endpoint: "0", Outcome: "allowed", Requests: 1},
+		{Endpoint: "0", Scope: "service", Outcome: "cancelled", Requests: 1},
+		{Endpoint: "0", Scope: "service", Outcome: "delayed", Requests: 1},
+	}
+	if stats := limiter.Stats(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestLimitFlag(t *testing.T) {
+	limits := limitFlag{}
+	for _, value := range []string{"/0=10", "1=2.5"} {
+		if err := limits.Set(value); err != nil {
+			t.Fatalf("Set(%s) error = %v", value, err)
+		}
+	}
+	if got, want := limits.String(), "/0=10 /1=2.5"; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+	for _, value := range []string{"/0", "/0=fast"} {
+		if err := limits.Set(value); err == nil {
+			t.Errorf("Set(%s) returned no error", value)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retryBudgetReserve is the number of retries a target starts with, so that
+// failures on a quiet service are retried before its traffic fills the budget
+const retryBudgetReserve = 10
+
+// RetryPolicy tells how the calls to a downstream service are retried.
+// Calls without a response (connection errors and hop timeouts) are always retryable.
+type RetryPolicy struct {
+	// Attempts is the maximum number of calls, 1 never retries
+	Attempts int
+	// Codes are the retryable status codes
+	Codes []int
+	// Backoff is the base wait before the first retry, doubled on every retry
+	Backoff time.Duration
+	// MaxBackoff bounds the wait between two calls
+	MaxBackoff time.Duration
+	// Budget is the percentage of the calls that may be retries
+	Budget float64
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:   1,
+	Codes:      []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	Backoff:    25 * time.Millisecond,
+	MaxBackoff: time.Second,
+	Budget:     20,
+}
+
+// retryable reports whether a call answered with code can be retried, 0 means no response
+func (p RetryPolicy) retryable(code int) bool {
+	if code == 0 {
+		return true
+	}
+	for _, retryable := range p.Codes {
+		if code == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before retrying the given attempt: exponential with full jitter
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := float64(p.Backoff) * math.Pow(2, float64(attempt-1))
+	if p.MaxBackoff > 0 && ceiling > float64(p.MaxBackoff) {
+		ceiling = float64(p.MaxBackoff)
+	}
+	return time.Duration(rand.Float64() * ceiling)
+}
+
+// sleepContext waits for d, or until ctx is done; it returns false in the latter case
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryBudget bounds the retries to a target to a percentage of its calls:
+// every call deposits a fraction of a retry, every retry withdraws a whole one
+type retryBudget struct {
+	mux     sync.Mutex
+	balance float64
+}
+
+var (
+	retryBudgetsMux sync.Mutex
+	retryBudgets    = map[string]*retryBudget{}
+)
+
+func retryBudgetFor(target string) *retryBudget {
+	retryBudgetsMux.Lock()
+	defer retryBudgetsMux.Unlock()
+
+	budget, ok := retryBudgets[target]
+	if !ok {
+		budget = &retryBudget{balance: retryBudgetReserve}
+		retryBudgets[target] = budget
+	}
+	return budget
+}
+
+func (b *retryBudget) deposit(percent float64) {
+	b.mux.Lock()
+	b.balance = math.Min(b.balance+percent/100, retryBudgetReserve)
+	b.mux.Unlock()
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+var retryPolicies = retryFlag{}
+
+// retryFlag collects the retry policies given on the command line as
+// [target:]key=value,... with the keys attempts, codes (separated by /),
+// backoff, max-backoff and budget, e.g. attempts=3,codes=502/503 for every
+// target or svc-1-mock:attempts=5,backoff=50ms for one. Keys left out keep
+// the value of the default policy given before.
+type retryFlag map[string]RetryPolicy
+
+func (f retryFlag) get(target string) RetryPolicy {
+	if policy, ok := f[target]; ok {
+		return policy
+	}
+	if policy, ok := f[""]; ok {
+		return policy
+	}
+	return defaultRetryPolicy
+}
+
+func (f retryFlag) String() string {
+	policies := make([]string, 0, len(f))
+	for target, policy := range f {
+		codes := make([]string, len(policy.Codes))
+		for i, code := range policy.Codes {
+			codes[i] = strconv.Itoa(code)
+		}
+		spec := fmt.Sprintf("attempts=%d,codes=%s,backoff=%v,max-backoff=%v,budget=%g",
+			policy.Attempts, strings.Join(codes, "/"), policy.Backoff, policy.MaxBackoff, policy.Budget)
+		if target != "" {
+			spec = target + ":" + spec
+		}
+		policies = append(policies, spec)
+	}
+	sort.Strings(policies)
+	return strings.Join(policies, " ")
+}
+
+func (f retryFlag) Set(value string) error {
+	target := ""
+	if kv := strings.SplitN(value, ":", 2); len(kv) == 2 && !strings.Contains(kv[0], "=") {
+		target, value = kv[0], kv[1]
+	}
+
+	policy := f.get("")
+	for _, param := range strings.Split(value, ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("parameter %s is not key=value", param)
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		var err error
+		switch key {
+		case "attempts":
+			policy.Attempts, err = strconv.Atoi(val)
+			if err == nil && policy.Attempts < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "codes":
+			policy.Codes = nil
+			for _, code := range strings.Split(val, "/") {
+				var c int
+				if c, err = strconv.Atoi(code); err != nil {
+					break
+				}
+				policy.Codes = append(policy.Codes, c)
+			}
+		case "backoff":
+			policy.Backoff, err = time.ParseDuration(val)
+			if err == nil && policy.Backoff < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "max-backoff":
+			policy.MaxBackoff, err = time.ParseDuration(val)
+			if err == nil && policy.MaxBackoff < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "budget":
+			policy.Budget, err = strconv.ParseFloat(val, 64)
+			if err == nil && (policy.Budget < 0 || policy.Budget > 100) {
+				err = fmt.Errorf("must be a percentage")
+			}
+		default:
+			return fmt.Errorf("unknown retry parameter %s", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	if policy.MaxBackoff < policy.Backoff {
+		return fmt.Errorf("max-backoff %v is shorter than backoff %v", policy.MaxBackoff, policy.Backoff)
+	}
+	f[target] = policy
+	return nil
+}
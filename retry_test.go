@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	tests := []struct {
+		code      int
+		retryable bool
+	}{
+		{code: 0, retryable: true},
+		{code: http.StatusBadGateway, retryable: true},
+		{code: http.StatusServiceUnavailable, retryable: true},
+		{code: http.StatusGatewayTimeout, retryable: true},
+		{code: http.StatusInternalServerError, retryable: false},
+		{code: http.StatusTooManyRequests, retryable: false},
+	}
+	for _, test := range tests {
+		if retryable := defaultRetryPolicy.retryable(test.code); retryable != test.retryable {
+			t.Errorf("retryable(%d) = %v, want %v", test.code, retryable, test.retryable)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{attempt: 1, ceiling: 10 * time.Millisecond},
+		{attempt: 2, ceiling: 20 * time.Millisecond},
+		{attempt: 3, ceiling: 40 * time.Millisecond},
+		{attempt: 4, ceiling: 50 * time.Millisecond},
+		{attempt: 10, ceiling: 50 * time.Millisecond},
+	}
+	for _, test := range tests {
+		var longest time.Duration
+		for i := 0; i < 1000; i++ {
+			backoff := policy.backoff(test.attempt)
+			if backoff < 0 || backoff > test.ceiling {
+				t.Fatalf("backoff(%d) = %v, want it in [0, %v]", test.attempt, backoff, test.ceiling)
+			}
+			if backoff > longest {
+				longest = backoff
+			}
+		}
+		// full jitter spreads the waits up to the ceiling
+		if longest < test.ceiling/2 {
+			t.Errorf("longest backoff(%d) = %v, want close to %v", test.attempt, longest, test.ceiling)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := &retryBudget{}
+	if budget.withdraw() {
+		t.Fatal("withdraw() from an empty budget succeeded")
+	}
+	// a 20% budget earns a retry every 5 calls
+	for i := 0; i < 5; i++ {
+		budget.deposit(20)
+	}
+	if !budget.withdraw() {
+		t.Fatal("withdraw() after 5 calls with a 20% budget failed")
+	}
+	if budget.withdraw() {
+		t.Fatal("withdraw() succeeded twice after 5 calls with a 20% budget")
+	}
+
+	// the balance never grows over the reserve
+	for i := 0; i < 1000; i++ {
+		budget.deposit(100)
+	}
+	withdrawn := 0
+	for budget.withdraw() {
+		withdrawn++
+	}
+	if withdrawn != retryBudgetReserve {
+		t.Errorf("withdrew %d retries from a full budget, want %d", withdrawn, retryBudgetReserve)
+	}
+}
+
+func TestRetryFlag(t *testing.T) {
+	policies := retryFlag{}
+	for _, value := range []string{"attempts=3,codes=502/503", "svc-1:attempts=5,backoff=50ms", "svc-2:budget=50,max-backoff=2s"} {
+		if err := policies.Set(value); err != nil {
+			t.Fatalf("Set(%s) error = %v", value, err)
+		}
+	}
+
+	defaults := defaultRetryPolicy
+	defaults.Attempts, defaults.Codes = 3, []int{502, 503}
+	svc1 := defaults
+	svc1.Attempts, svc1.Backoff = 5, 50*time.Millisecond
+	svc2 := defaults
+	svc2.Budget, svc2.MaxBackoff = 50, 2*time.Second
+	tests := []struct {
+		target string
+		policy RetryPolicy
+	}{
+		{target: "svc-1", policy: svc1},
+		{target: "svc-2", policy: svc2},
+		{target: "svc-3", policy: defaults},
+	}
+	for _, test := range tests {
+		if policy := policies.get(test.target); !reflect.DeepEqual(policy, test.policy) {
+			t.Errorf("get(%s) = %+v, want %+v", test.target, policy, test.policy)
+		}
+	}
+	if policy := (retryFlag{}).get("svc-1"); !reflect.DeepEqual(policy, defaultRetryPolicy) {
+		t.Errorf("get() without policies = %+v, want the default policy", policy)
+	}
+
+	want := "attempts=3,codes=502/503,backoff=25ms,max-backoff=1s,budget=20 " +
+		"svc-1:attempts=5,codes=502/503,backoff=50ms,max-backoff=1s,budget=20 " +
+		"svc-2:attempts=3,codes=502/503,backoff=25ms,max-backoff=2s,budget=50"
+	if got := policies.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+
+	errors := []struct {
+		value string
+		err   string
+	}{
+		{value: "attempts=0", err: "must be at least 1"},
+		{value: "attempts", err: "is not key=value"},
+		{value: "codes=502/bad", err: "codes"},
+		{value: "backoff=soon", err: "backoff"},
+		{value: "backoff=-1ms", err: "backoff: must not be negative"},
+		{value: "max-backoff=-1s", err: "max-backoff: must not be negative"},
+		{value: "backoff=2s", err: "max-backoff 1s is shorter than backoff 2s"},
+		{value: "backoff=100ms,max-backoff=50ms", err: "max-backoff 50ms is shorter than backoff 100ms"},
+		{value: "budget=120", err: "must be a percentage"},
+		{value: "svc-1:timeout=1s", err: "unknown retry parameter timeout"},
+	}
+	for _, test := range errors {
+		if err := (retryFlag{}).Set(test.value); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Set(%s) error = %v, want %q", test.value, err, test.err)
+		}
+	}
+}
+
+func TestCallDownstreamRetries(t *testing.T) {
+	tests := []struct {
+		name string
+		// failures is the number of calls answered 503 before the first 200
+		failures int
+		policy   string
+		// balance is the retry budget of the target, -1 leaves it full
+		balance float64
+		calls   int32
+		status  int
+	}{
+		{name: "no retry by default", failures: 1, balance: -1, calls: 1, status: http.StatusBadGateway},
+		{name: "retried until success", failures: 2, policy: "attempts=3,backoff=1ms", balance: -1, calls: 3, status: http.StatusOK},
+		{name: "out of attempts", failures: 5, policy: "attempts=3,backoff=1ms", balance: -1, calls: 3, status: http.StatusBadGateway},
+		{name: "status not retryable", failures: 1, policy: "attempts=3,backoff=1ms,codes=502", balance: -1, calls: 1, status: http.StatusBadGateway},
+		{name: "budget exhausted", failures: 1, policy: "attempts=3,backoff=1ms,budget=0", balance: 0, calls: 1, status: http.StatusBadGateway},
+	}
+
+	defer func(port string, policies retryFlag) { globalPort, retryPolicies = port, policies }(globalPort, retryPolicies)
+	tracer := opentracing.Tracer(opentracing.NoopTracer{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) <= int32(test.failures) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte("ok"))
+			}))
+			defer server.Close()
+
+			target, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			globalPort = port
+			retryPolicies = retryFlag{}
+			if test.policy != "" {
+				if err := retryPolicies.Set(test.policy); err != nil {
+					t.Fatal(err)
+				}
+			}
+			retryBudgetsMux.Lock()
+			retryBudgets = map[string]*retryBudget{}
+			retryBudgetsMux.Unlock()
+			if test.balance >= 0 {
+				retryBudgetFor(target).balance = test.balance
+			}
+
+			span := tracer.StartSpan("test")
+			body, status := callDownstream(context.Background(), target, "0", []byte("body"), &tracer, &span)
+			if calls := atomic.LoadInt32(&calls); status != test.status || calls != test.calls {
+				t.Fatalf("status = %d after %d calls, want %d after %d", status, calls, test.status, test.calls)
+			}
+			if status == http.StatusOK && string(body) != "ok" {
+				t.Errorf("body = %q, want %q", body, "ok")
+			}
+		})
+	}
+}
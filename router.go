@@ -7,21 +7,19 @@ import (
 	"github.com/gorilla/mux"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
-	"github.com/uber/jaeger-lib/metrics"
-	"golang.org/x/time/rate"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/uber/jaeger-client-go"
-	jaegercfg "github.com/uber/jaeger-client-go/config"
-	jaegerlog "github.com/uber/jaeger-client-go/log"
 )
 
 /**
@@ -29,11 +27,46 @@ import (
 * ID- the name of this particular Service
 * RequestsPerSecond- An integer value that represents the number of requests this microsecond can make per second
 * ProcessTime- An integer value that represents the amount of time this Microservice spends on Processing a request
+* Load- The CPU load in [0, 1] derived from the parameters, it scales the CPU time burned per message
+* ProcessTimes- The distribution of the time (ms) to process a message, per endpoint
+* MessageSizes- The distribution of the size (bytes) of the messages sent, per endpoint
+* Latency- The time added to the processing of every message by the latency function
+* RequestsPerSecond, Load and Latency change when the parameters are tuned at runtime, read them with Rates and AddedLatency
 **/
 type Service struct {
 	ID                string
 	RequestsPerSecond float64
 	ProcessTime       int
+	Load              float64
+	Latency           time.Duration
+	ProcessTimes      *Distributions
+	MessageSizes      *Distributions
+
+	mux sync.RWMutex
+}
+
+// Tune sets the CPU load, the requests per second and the latency given by params
+func (s *Service) Tune(params Parameters) {
+	load, rps, latency := params.Load(), params.RequestsPerSecond(), params.Latency()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.RequestsPerSecond = rps
+	s.Load = load
+	s.Latency = latency
+}
+
+// Rates returns the requests per second and the CPU load of the service
+func (s *Service) Rates() (float64, float64) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.RequestsPerSecond, s.Load
+}
+
+// AddedLatency returns the time added to the processing of every message
+func (s *Service) AddedLatency() time.Duration {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Latency
 }
 
 var (
@@ -43,6 +76,8 @@ var (
 	name                string
 	msgSize             uint
 	msgTime             uint
+	msgSizeDist         = endpointSpecFlag{"": "normal:stddev=10"}
+	msgTimeDist         = endpointSpecFlag{"": "constant"}
 	randomSeed          int64
 	x                   int
 	y                   int
@@ -55,23 +90,78 @@ var (
 	g                   float64
 	h                   float64
 	zipkin_black_hole   string
-	sampling_black_hole string
-	throttling          <-chan time.Time
-	root				bool
-	limiter				*rate.Limiter
-	ctx					context.Context
+	samplingSpecs       = endpointSpecFlag{"": samplingNever}
+	sampleErrors        bool
+	sampleSlow          time.Duration
+	samplingPolicy      *SamplingPolicy
+	tracerKind          string
+	tracerEndpoint      string
+	topologyFile        string
+	topologyWatch       time.Duration
+	workers             int
+	queueDepth          int
+	queueOverflow       string
+	limitMode           string
+	limitBurst          int
+	endpointLimits      = limitFlag{}
+	clientLimit         float64
+	root                bool
 )
 
 func main() {
-	writePid()
-
-	flag.StringVar(&zipkin_black_hole, "zipkin", "", "blackhole")
-	flag.StringVar(&sampling_black_hole, "sampling", "", "blackhole")
+	flag.StringVar(&zipkin_black_hole, "zipkin", "", "tracer address (host:port), used when --tracer-endpoint is not set")
+	flag.StringVar(&tracerKind, "tracer", tracerJaeger, "tracer: jaeger, zipkin, otlp or none")
+	flag.StringVar(&tracerEndpoint, "tracer-endpoint", "", "jaeger agent, zipkin server or otlp collector address (host:port)")
+	flag.Var(samplingSpecs, "sampling", "traces sampled by the service, /endpoint=spec sets it per endpoint (repeatable)")
+	flag.BoolVar(&sampleErrors, "sample-errors", false, "keep the spans answered with a 5xx status code even if not sampled")
+	flag.DurationVar(&sampleSlow, "sample-slow", 0, "keep the spans lasting longer even if not sampled, 0 keeps none")
+	flag.StringVar(&otlpProtocol, "otlp-protocol", otlpGrpc, "protocol of the otlp collector: grpc or http")
+	flag.StringVar(&otlpFile, "otlp-file", "", "file where the otlp tracer also writes spans and metrics as JSON lines")
+	flag.BoolVar(&otlpMetrics, "otlp-metrics", false, "push the metrics to the otlp collector, requires --tracer=otlp")
+	flag.DurationVar(&otlpMetricsInterval, "otlp-metrics-interval", 15*time.Second, "interval between two pushes of the metrics")
 	flag.StringVar(&name, "name", "", "service name")
+	flag.BoolVar(&root, "root", false, "start a new trace on every request, ignoring inbound trace headers")
+	flag.StringVar(&topologyFile, "topology", "", "JSON or YAML file describing the paths, e.g. the generated/topology.json written by uApp-generator.py (default: compiled-in route map)")
+	flag.DurationVar(&topologyWatch, "topology-watch", 5*time.Second, "interval to check the topology file for changes, 0 reloads on SIGHUP only")
 	flag.IntVar(&port, "port", 8080, "port")
 	flag.Int64Var(&randomSeed, "random-seed", 42, "random seed")
 	flag.UintVar(&msgSize, "msg-size", 256, "average size in bytes default:256")
 	flag.UintVar(&msgTime, "msg-time", 10, "Time do compute an msg-request default 10ms")
+	flag.Var(msgSizeDist, "msg-size-dist", "distribution of the message size around msg-size, /endpoint=spec sets it per endpoint (repeatable)")
+	flag.Var(msgTimeDist, "msg-time-dist", "distribution of the processing time around msg-time, /endpoint=spec sets it per endpoint (repeatable)")
+	flag.IntVar(&workers, "workers", 0, "number of requests served at the same time, 0 serves every request immediately")
+	flag.IntVar(&queueDepth, "queue-depth", 100, "number of requests waiting for a worker")
+	flag.StringVar(&queueOverflow, "queue-overflow", queueBlock, "when the queue is full: block or reject (503)")
+	flag.StringVar(&limitMode, "limit-mode", limitWait, "requests over the rate limit: wait, reject (429) or shed (503)")
+	flag.IntVar(&limitBurst, "limit-burst", 1, "requests allowed above the rate limit at once, at least 1")
+	flag.Var(endpointLimits, "endpoint-limit", "requests per second of an endpoint as /endpoint=rps (repeatable)")
+	flag.Float64Var(&clientLimit, "client-limit", 0, "requests per second of each client IP, 0 for no limit")
+	flag.DurationVar(&requestTimeout, "request-timeout", 0, "time to answer a request arriving without "+timeoutHeader+", 0 for no limit")
+	flag.Var(hopTimeouts, "hop-timeout", "time to wait for a downstream call, target=duration sets it per target (repeatable), 0 for no limit")
+	flag.Var(retryPolicies, "retry", "retry policy of the downstream calls as [target:]attempts=3,codes=502/503/504,backoff=25ms,max-backoff=1s,budget=20 (repeatable)")
+	flag.Var(breakerPolicies, "breaker", "circuit breaker of the downstream calls as [target:]failures=5,error-rate=50,window=10s,min-requests=20,open=5s,probes=1,fallback=503 (repeatable)")
+	flag.Var(&hedgeDelay, "hedge-delay", "time to wait for a downstream call before sending a duplicate, as a duration or pNN for a latency percentile, 0 disables hedging")
+	flag.StringVar(&hedgeTarget, "hedge-target", hedgeSame, "where duplicates go: same target, or replica for another address the target resolves to")
+	flag.Var(&faultSpecs, "fault", "fault injected into requests as type[:percent=10,endpoint=,caller=,header=Name=value,code=503,delay=100ms,distribution=] with type error, delay, reset, truncate or hang (repeatable)")
+	flag.StringVar(&cpuWork, "cpu-work", cpuWorkHash, "CPU work done per message: hash, spin or none")
+	flag.DurationVar(&maxCpuTime, "max-cpu-time", time.Second, "maximum CPU time burned per message, 0 for no limit")
+	flag.StringVar(&cpuProfile, "cpu-profile", "constant", "load profile scaling the CPU time per message over time: constant, step, ramp, sine, spike or replay[:key=value,...]")
+	flag.StringVar(&memoryProfile, "memory-profile", "constant", "load profile scaling the memory held over time: constant, step, ramp, sine, spike or replay[:key=value,...]")
+	flag.DurationVar(&profileInterval, "profile-interval", time.Second, "time between two updates of the load profiles")
+	flag.StringVar(&cpuFunction, "cpu-function", "beale", "function of the parameters giving the CPU load: "+strings.Join(objectiveNames(), ", ")+" or expr[:key=value,...]")
+	flag.StringVar(&memoryFunction, "memory-function", "himmelblau", "function of the parameters giving the memory held, as for --cpu-function")
+	flag.StringVar(&latencyFunction, "latency-function", "none", "function of the parameters giving the latency added to every message, as for --cpu-function, or none")
+	flag.StringVar(&throughputFunction, "throughput-function", "none", "function of the parameters giving the requests per second, as for --cpu-function, or none to derive them from the CPU load")
+	flag.DurationVar(&maxLatency, "max-latency", 100*time.Millisecond, "latency added at the maximum of the latency function")
+	flag.IntVar(&epsilon, "memory-unit", 32, "MiB of memory held per unit of the memory function")
+	flag.Float64Var(&memoryChurn, "memory-churn", 0, "fraction of the memory held replaced every memory-churn-interval to put the GC under pressure, 0 for none")
+	flag.DurationVar(&memoryChurnInterval, "memory-churn-interval", time.Second, "time between two replacements of the memory held")
+	flag.StringVar(&parametersFile, "parameters", "", "JSON or YAML file with the a..h, x, y parameters, applied again when it changes")
+	flag.DurationVar(&parametersWatch, "parameters-watch", 5*time.Second, "interval to check the parameters file for changes, 0 reloads on SIGHUP only")
+	flag.BoolVar(&printSearchSpace, "print-searchspace", false, "print the search space of the parameters as JSON and exit")
+	flag.StringVar(&evaluateSpec, "evaluate", "", "evaluate the model over the search space, print the predictions as CSV and exit: grid[:points=3] or random[:samples=1000]")
+	flag.DurationVar(&shutdownDelay, "shutdown-delay", 5*time.Second, "time /health fails on SIGTERM before the service stops accepting connections")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", 20*time.Second, "time the requests in flight have to finish on shutdown")
 	flag.IntVar(&x, "x", 0, "parameter X")
 	flag.IntVar(&y, "y", 0, "parameter Y")
 	flag.Float64Var(&a, "a", 0, "parameter A")
@@ -84,54 +174,123 @@ func main() {
 	flag.Float64Var(&h, "h", 0, "parameter H")
 	flag.Parse()
 
-	addrs := flag.Args()
+	if err := setObjectives(cpuFunction, memoryFunction, latencyFunction, throughputFunction); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("functions: cpu %s, memory %s, latency %s, throughput %s\n", cpuObjective, memoryObjective, latencyObjective, throughputObjective)
+	parameters := Parameters{X: x, Y: y, A: a, B: b, C: c, D: d, E: e, F: f, G: g, H: h}
+	if len(parametersFile) > 0 {
+		var err error
+		parameters, err = loadParameters(parametersFile, parameters)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded parameters from %s\n", parametersFile)
+	}
+	if printSearchSpace {
+		if err := writeSearchSpace(os.Stdout, newSearchSpace(parameters)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(evaluateSpec) > 0 {
+		// the functions log every evaluation
+		log.SetOutput(ioutil.Discard)
+		best, count, err := evaluate(evaluateSpec, os.Stdout)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			log.Fatalf("invalid --evaluate: %v", err)
+		}
+		log.Printf("evaluated %d points, best objective %g: %+v\n", count, best.Objective, best)
+		return
+	}
+
+	targets := NewTargets(flag.Args())
 
 	if len(name) <= 0 {
 		log.Fatal("argument --name must be set")
 	}
-	globalName = name
-	root = false
-	if globalName == "svc-0-mock" {
-		root = true
+	if workers < 0 {
+		log.Fatalf("argument --workers must be at least 1, or 0 to serve every request immediately")
 	}
+	if queueDepth < 0 {
+		log.Fatalf("argument --queue-depth must not be negative")
+	}
+	if queueOverflow != queueBlock && queueOverflow != queueReject {
+		log.Fatalf("argument --queue-overflow must be %s or %s", queueBlock, queueReject)
+	}
+	switch tracerKind {
+	case tracerJaeger, tracerZipkin, tracerOtlp, tracerNone:
+	default:
+		log.Fatalf("argument --tracer must be %s, %s, %s or %s", tracerJaeger, tracerZipkin, tracerOtlp, tracerNone)
+	}
+	if otlpProtocol != otlpGrpc && otlpProtocol != otlpHttp {
+		log.Fatalf("argument --otlp-protocol must be %s or %s", otlpGrpc, otlpHttp)
+	}
+	if otlpMetrics && tracerKind != tracerOtlp {
+		log.Fatalf("argument --otlp-metrics requires --tracer=%s", tracerOtlp)
+	}
+	if hedgeTarget != hedgeSame && hedgeTarget != hedgeReplica {
+		log.Fatalf("argument --hedge-target must be %s or %s", hedgeSame, hedgeReplica)
+	}
+	if limitMode != limitWait && limitMode != limitReject && limitMode != limitShed {
+		log.Fatalf("argument --limit-mode must be %s, %s or %s", limitWait, limitReject, limitShed)
+	}
+	if cpuWork != cpuWorkHash && cpuWork != cpuWorkSpin && cpuWork != cpuWorkNone {
+		log.Fatalf("argument --cpu-work must be %s, %s or %s", cpuWorkHash, cpuWorkSpin, cpuWorkNone)
+	}
+	if maxCpuTime < 0 {
+		log.Fatalf("argument --max-cpu-time must not be negative")
+	}
+	if limitBurst < 1 {
+		log.Fatalf("argument --limit-burst must be at least 1")
+	}
+	if profileInterval <= 0 {
+		log.Fatalf("argument --profile-interval must be positive")
+	}
+	if epsilon <= 0 {
+		log.Fatalf("argument --memory-unit must be positive")
+	}
+	if memoryChurn < 0 || memoryChurn > 1 {
+		log.Fatalf("argument --memory-churn must be in [0, 1]")
+	}
+	if memoryChurn > 0 && memoryChurnInterval <= 0 {
+		log.Fatalf("argument --memory-churn-interval must be positive")
+	}
+	globalName = name
 	globalPort = strconv.Itoa(port)
+	writePid()
 	rand.Seed(randomSeed)
 
+	topology := &Topology{Paths: routeMapToPaths(generatedRouteMap)}
+	if len(topologyFile) > 0 {
+		var err error
+		topology, err = loadTopology(topologyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded %d paths from %s\n", len(topology.Paths), topologyFile)
+	}
+
 	log.Println("setting tracer")
-	// Sample configuration for testing. Use constant sampling to sample every trace
-	// and enable LogSpan to log every span via configured Logger.
-	sampling, _ := strconv.ParseFloat(sampling_black_hole, 64)
-	cfg := jaegercfg.Configuration{
-		ServiceName: name,
-		Sampler:     &jaegercfg.SamplerConfig{
-			Type:  jaeger.SamplerTypeConst,
-			Param: sampling,
-		},
-		//LocalAgentHostPort instructs reporter to send spans to jaeger-agent at this address. Can be provided by FromEnv() via the environment variable named JAEGER_AGENT_HOST / JAEGER_AGENT_PORT
-		Reporter:    &jaegercfg.ReporterConfig{
-			LogSpans: true,
-			LocalAgentHostPort: zipkin_black_hole,
-		},
-	}
-
-	// Example logger and metrics factory. Use github.com/uber/jaeger-client-go/log
-	// and github.com/uber/jaeger-lib/metrics respectively to bind to real logging and metrics
-	// frameworks.
-	jLogger := jaegerlog.StdLogger
-	jMetricsFactory := metrics.NullFactory
-
-	// Initialize tracer with a logger and a metrics factory
-	tracer, closer, err := cfg.NewTracer(
-		jaegercfg.Logger(jLogger),
-		jaegercfg.Metrics(jMetricsFactory),
-
-	)
+	var err error
+	samplingPolicy, err = newSamplingPolicy(samplingSpecs, sampleErrors, sampleSlow)
+	if err != nil {
+		log.Fatalf("invalid --sampling: %v", err)
+	}
+	log.Printf("sampling: %s\n", samplingSpecs)
+	if len(tracerEndpoint) <= 0 {
+		tracerEndpoint = zipkin_black_hole
+	}
+	tracer, closer, err := newTracer(tracerKind, name, tracerEndpoint, samplingPolicy)
 	if err != nil {
 		log.Printf("error to initialize tracer: %+v\n", err)
+		tracer, closer, _ = newTracer(tracerNone, name, "", samplingPolicy)
 	}
-	// Set the singleton opentracing.Tracer with the Jaeger tracer.
+	// Set the singleton opentracing.Tracer with the selected tracer.
 	opentracing.SetGlobalTracer(tracer)
-	defer closer.Close()
+	// flushed on shutdown
+	closers := []io.Closer{closer}
 
 	log.Printf("listening on %s", name)
 
@@ -144,167 +303,384 @@ func main() {
 	microservice.ProcessTime = int(msgTime)
 
 	//calculate the number of requests per second that are handled on average based on the CPU load and processing time
-	load := getCpuUsage(x, y, a, b, c, d, e, f, g, h) / 100
-	// 500 -> 10K
-	microservice.RequestsPerSecond = load * 2000
-	//rt := rate.Every(1000000000 / (time.Duration(microservice.RequestsPerSecond)*time.Nanosecond))
-	//limiter = rate.NewLimiter(rt,0)
-	//ctx = context.Background()
-	log.Printf("load: %f, proc time: %d, reqps: %f", load, microservice.ProcessTime, microservice.RequestsPerSecond)
+	microservice.Tune(parameters)
+	rps, load := microservice.Rates()
+	log.Printf("load: %f, proc time: %d, reqps: %f, latency: %v", load, microservice.ProcessTime, rps, microservice.AddedLatency())
+
+	processTimes, err := newDistributions(msgTimeDist, float64(msgTime), randomSeed)
+	if err != nil {
+		log.Fatalf("invalid --msg-time-dist: %v", err)
+	}
+	microservice.ProcessTimes = processTimes
+	messageSizes, err := newDistributions(msgSizeDist, float64(msgSize), randomSeed+1)
+	if err != nil {
+		log.Fatalf("invalid --msg-size-dist: %v", err)
+	}
+	microservice.MessageSizes = messageSizes
+	log.Printf("processing time: %s, message size: %s", msgTimeDist, msgSizeDist)
 
-	throttling = time.Tick(time.Second / time.Duration(microservice.RequestsPerSecond))
-	//throttling = time.Tick(time.Duration(microservice.RequestsPerSecond))
+	cpuLoadProfile, err := newLoadProfile(cpuProfile)
+	if err != nil {
+		log.Fatalf("invalid --cpu-profile: %v", err)
+	}
+	memoryLoadProfile, err := newLoadProfile(memoryProfile)
+	if err != nil {
+		log.Fatalf("invalid --memory-profile: %v", err)
+	}
 
-	SetMemUsage(x, y, a, b, c, d, e, f, g, h)
+	memory := SetMemUsage(parameters.X, parameters.Y, parameters.A, parameters.B, parameters.C, parameters.D, parameters.E, parameters.F, parameters.G, parameters.H)
+	go runLoadProfiles(cpuLoadProfile, memoryLoadProfile, memory, profileInterval)
+	if memoryChurn > 0 {
+		go runChurn(memory, memoryChurn, memoryChurnInterval)
+	}
+	log.Printf("load profiles: cpu %s, memory %s", cpuLoadProfile, memoryLoadProfile)
 
 	r := mux.NewRouter()
 
-	r.Methods("POST").Path("/all").HandlerFunc(callAllTargets("all", microservice, addrs))
-	r.Methods("GET").Path("/health").HandlerFunc(healthz())
-	r.Methods("POST").Path("/random").HandlerFunc(callRandomTargets("random", microservice, addrs))
+	r.Methods("POST").Path("/all").HandlerFunc(callAllTargets("all", microservice, targets))
+	r.Methods("POST").Path("/random").HandlerFunc(callRandomTargets("random", microservice, targets))
 
-	for key, _ := range generatedRouteMap {
-		log.Printf("creating endpoint /%s\n", key)
-		r.Methods("POST").Path("/" + key).HandlerFunc(handleRequest(name, key, microservice))
+	paths := NewPathRoutes(topology, func(topology *Topology, key string) http.HandlerFunc {
+		return handleRequest(name, key, microservice, topology)
+	})
+	r.PathPrefix("/").Handler(paths)
+	if len(topologyFile) > 0 {
+		go watchTopology(topologyFile, topologyWatch, paths)
 	}
+	faultInjector = NewFaultInjector(faultSpecs, paths)
+
+	// the admin API is not throttled so the service stays manageable under load
+	label := func(path string) string {
+		return endpointLabel(paths, path)
+	}
+	limiter := NewRateLimiter(rps, limitBurst, limitMode, endpointLimits, clientLimit, label)
+
+	router := mux.NewRouter()
+	registerAdminRoutes(router, paths, targets)
+	registerAdminLimits(router, limiter)
+	registerAdminBreakers(router)
+	registerAdminFaults(router, faultInjector)
+	registerAdminMemory(router, memory)
+	registerAdminFunctions(router)
+	tuner := NewTuner(parameters, microservice, limiter, memory)
+	registerAdminParameters(router, tuner)
+	registerAdminSearchSpace(router, tuner)
+	registerAdminPredict(router, tuner)
+	if len(parametersFile) > 0 {
+		go watchParameters(parametersFile, parametersWatch, tuner)
+	}
+	handler := http.Handler(r)
+	var queue *WorkQueue
+	if workers > 0 {
+		queue = NewWorkQueue(workers, queueDepth, queueOverflow)
+		registerAdminQueue(router, queue)
+		handler = queue.Handler(handler)
+	}
+	registerMetrics(router, limiter, queue, memory)
+	// like the admin API, the probes are neither throttled, queued nor timed out
+	router.Methods("GET").Path("/health").HandlerFunc(healthz())
+	setParameterMetrics(microservice, parameters)
+	if otlpMetrics {
+		metricsCloser, err := startOtlpMetrics(name, tracerEndpoint)
+		if err != nil {
+			log.Printf("error to initialize otlp metrics: %+v\n", err)
+		} else {
+			closers = append(closers, metricsCloser)
+		}
+	}
+	router.PathPrefix("/").Handler(instrument(withDeadline(limiter.Handler(handler)), label))
 
 	srv := &http.Server{
-		Handler: limit(r),
+		Handler: router,
 		Addr:    ":" + globalPort,
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	if err := serveUntilTerminated(srv, shutdownDelay, shutdownGrace, closers); err != nil {
+		log.Fatalf("server stopped: %v", err)
+	}
 }
 
-func limit(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		<- throttling
-		//limiter.Wait(ctx)
-		//if limiter.Allow() == false {
-			//http.Error(w, http.StatusText(429), http.StatusTooManyRequests)
-			//http.Error(w, http.StatusText(504), http.StatusGatewayTimeout)
-			//return
-		//}
-
-		next.ServeHTTP(w, r)
-	})
+func pidFile() string {
+	return "/tmp/" + globalName + "-ms.pid"
 }
 
 func writePid() {
 	pid := os.Getpid()
 	bpid := []byte(strconv.Itoa(pid))
-	ioutil.WriteFile("/tmp/"+globalName+"-ms.pid", bpid, 0644)
+	ioutil.WriteFile(pidFile(), bpid, 0644)
 }
 
-func doSomething(service *Service) []byte {
-	log.Println("mocking processing")
-	//go FinityCpuUsage(uint(service.ProcessTime),x,y,a,b,c,d,e,f,g,h)
-	fakeBody := make([]byte, integerNormalDistribution(msgSize, 10))
-	log.Printf("processing... body_size:%d, service:%+v\n", len(fakeBody), service)
-	log.Printf(" --- ## %+v ## --- \n", service)
-	return fakeBody
+func removePid() {
+	if err := os.Remove(pidFile()); err != nil && !os.IsNotExist(err) {
+		log.Printf("error removing %s: %v\n", pidFile(), err)
+	}
 }
 
-func integerNormalDistribution(mean uint, dev uint) uint {
-	return uint(math.Round(rand.NormFloat64()*float64(dev))) + mean
+func doSomething(ctx context.Context, service *Service, requestType string) []byte {
+	log.Println("mocking processing")
+	processTime := service.ProcessTimes.Sample(requestType)
+	rps, load := service.Rates()
+	burned := burnCpu(ctx, cpuTimePerRequest(processTime, load))
+	log.Printf("burned %v of CPU\n", burned)
+	if latency := service.AddedLatency(); latency > 0 {
+		sleepContext(ctx, latency)
+	}
+	fakeBody := make([]byte, int(math.Round(service.MessageSizes.Sample(requestType))))
+	log.Printf("processing... body_size:%d, service:%s, load:%f, reqps:%f\n", len(fakeBody), service.ID, load, rps)
+	return fakeBody
 }
 
-func callNext(target string, requestType string, service *Service, w http.ResponseWriter, tracer *opentracing.Tracer, clientSpan *opentracing.Span) ([]byte, int) {
+// callNext processes the request and calls target, if any. The ST-* headers of the
+// response are set on header
+func callNext(ctx context.Context, target string, requestType string, service *Service, header http.Header, tracer *opentracing.Tracer, clientSpan *opentracing.Span) ([]byte, int) {
 	log.Println("-- buffering to queue -- ")
 
-	body := doSomething(service)
+	body := doSomething(ctx, service, requestType)
+	if err := ctx.Err(); err != nil {
+		log.Printf("request cancelled while processing: %v\n", err)
+		header.Set("ST-Size-Bytes", "0")
+		if timedOut(ctx) {
+			(*clientSpan).LogKV("event", "timeout", "message", "deadline passed while processing")
+			return []byte{0}, http.StatusGatewayTimeout
+		}
+		return []byte{0}, http.StatusServiceUnavailable
+	}
 	(*clientSpan).SetBaggageItem("request-"+target+"-length", strconv.Itoa(len(body)))
 	if target != "" {
-		w.Header().Set("Next-Hop", target)
-		w.Header().Set("ST-Termination", "false")
-
-		url := "http://"+target+":"+globalPort+"/"+requestType
-		log.Printf("Calling next %s\n", "http://"+target+":"+globalPort+"/"+requestType)
-		//resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer(body))
-		req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+		header.Set("Next-Hop", target)
+		header.Set("ST-Termination", "false")
 
+		responseBody, httpStatus := callDownstream(ctx, target, requestType, body, tracer, clientSpan)
+		if httpStatus != http.StatusOK {
+			header.Set("ST-Size-Bytes", "0")
+			(*clientSpan).SetBaggageItem("response-"+target+"-length", "0")
+			return []byte{0}, httpStatus
+		}
+		log.Printf("response body %d == %d + %d\n", len(body) + len(responseBody), len(body), len(responseBody))
+		body = append(body, responseBody...)
+		header.Set("ST-Size-Bytes", strconv.Itoa(len(body)))
+	} else {
+		header.Set("ST-Termination", "true")
+		header.Set("ST-Size-Bytes", strconv.Itoa(len(body)))
+	}
 
-		// Set some tags on the clientSpan to annotate that it's the client span. The additional HTTP tags are useful for debugging purposes.
-		ext.SpanKindRPCClient.Set(*clientSpan)
-		ext.HTTPUrl.Set(*clientSpan, url)
-		ext.HTTPMethod.Set(*clientSpan, "POST")
+	(*clientSpan).SetBaggageItem("response-"+target+"-length", strconv.Itoa(len(body)))
+	log.Println(" -- unbuffering -- ")
+	return body, http.StatusOK
+}
 
-		// Inject the client span context into the headers
-		(*tracer).Inject((*clientSpan).Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-		resp, err := http.DefaultClient.Do(req)
+// callDownstream sends body to target, retrying as the retry policy of target allows,
+// and returns the response body with the status to answer: 200, 504 if a deadline
+// passed, 502 otherwise. While the circuit breaker of target is open it returns its
+// fallback without calling target
+func callDownstream(ctx context.Context, target string, requestType string, body []byte, tracer *opentracing.Tracer, span *opentracing.Span) ([]byte, int) {
+	policy := retryPolicies.get(target)
+	budget := retryBudgetFor(target)
+	budget.deposit(policy.Budget)
+	breaker := breakerFor(target)
+
+	for attempt := 1; ; attempt++ {
+		var call breakerCall
+		if breaker != nil {
+			var allowed bool
+			if call, allowed = breaker.Allow(); !allowed {
+				log.Printf("circuit breaker of %s is open\n", target)
+				(*span).LogKV("event", "circuit open", "target", target, "fallback", breaker.policy.Fallback)
+				return breaker.Fallback()
+			}
+		}
 
-		(*tracer).Inject((*clientSpan).Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
-		if err != nil {
-			log.Printf("Error calling %s %+v\n", url, err)
-			w.Header().Set("ST-Size-Bytes", "0")
-			(*clientSpan).SetBaggageItem("response-"+target+"-length", "0")
-			return []byte{0}, http.StatusBadGateway
+		responseBody, code, httpStatus := sendHedged(ctx, target, requestType, body, tracer, span)
+		// a call cut short by the client going away says nothing about the target
+		if breaker != nil {
+			if code != 0 || ctx.Err() == nil {
+				breaker.Record(call, httpStatus == http.StatusOK, responseBody)
+			} else {
+				breaker.Release(call)
+			}
+		}
+		if httpStatus == http.StatusOK {
+			return responseBody, httpStatus
+		}
+		if attempt >= policy.Attempts || !policy.retryable(code) || ctx.Err() != nil {
+			return []byte{0}, httpStatus
+		}
+		if !budget.withdraw() {
+			retryBudgetExhaustedTotal.WithLabelValues(target, requestType).Inc()
+			(*span).LogKV("event", "retry budget exhausted", "target", target, "attempt", attempt)
+			return []byte{0}, httpStatus
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode == http.StatusOK {
-			responseBody, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Fatal(err)
+		backoff := policy.backoff(attempt)
+		log.Printf("retrying %s in %v after %d\n", target, backoff, code)
+		(*span).LogKV("event", "retry", "target", target, "attempt", attempt+1, "status", code, "backoff", backoff.String())
+		downstreamRetriesTotal.WithLabelValues(target, requestType).Inc()
+		if !sleepContext(ctx, backoff) {
+			if timedOut(ctx) {
+				return []byte{0}, http.StatusGatewayTimeout
 			}
-			log.Printf("response body %d == %d + %d\n", len(body) + len(responseBody), len(body), len(responseBody))
-			body = append(body, responseBody...)
-			w.Header().Set("ST-Size-Bytes", strconv.Itoa(len(body)))
-		} else {
-			log.Printf("HTTP Error %d calling %s\n", resp.StatusCode, "http://"+target+":"+globalPort+"/"+requestType)
-			w.Header().Set("ST-Size-Bytes", "0")
-			(*clientSpan).SetBaggageItem("response-"+target+"-length", "0")
-			return []byte{0}, http.StatusBadGateway
+			return []byte{0}, httpStatus
 		}
-	} else {
-		w.Header().Set("ST-Termination", "true")
-		w.Header().Set("ST-Size-Bytes", strconv.Itoa(len(body)))
 	}
+}
 
-	(*clientSpan).SetBaggageItem("response-"+target+"-length", strconv.Itoa(len(body)))
-	log.Println(" -- unbuffering -- ")
-	return body, http.StatusOK
+// sendRequest sends body to target once. It returns the response body, the status
+// code received (0 if there was no response) and the status to answer
+func sendRequest(ctx context.Context, target string, requestType string, body []byte, tracer *opentracing.Tracer, clientSpan *opentracing.Span) ([]byte, int, int) {
+	return sendRequestTo(ctx, target, target, requestType, body, tracer, clientSpan)
 }
 
-func handleRequest(name string, requestType string, service *Service) http.HandlerFunc {
+// sendRequestTo sends body to target at addr, the name of target or the address of
+// one of its replicas, and returns like sendRequest
+func sendRequestTo(ctx context.Context, target string, addr string, requestType string, body []byte, tracer *opentracing.Tracer, clientSpan *opentracing.Span) ([]byte, int, int) {
+	url := "http://"+net.JoinHostPort(addr, globalPort)+"/"+requestType
+	log.Printf("Calling next %s\n", url)
+	//resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer(body))
+	// the call is cancelled when the hop times out, the deadline of the request
+	// passes or the client goes away
+	hopCtx, cancel := hopContext(ctx, target)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(hopCtx, "POST", url, bytes.NewBuffer(body))
+	setTimeoutHeader(hopCtx, req.Header)
+	req.Header.Set(callerHeader, globalName)
+
+	// Set some tags on the clientSpan to annotate that it's the client span. The additional HTTP tags are useful for debugging purposes.
+	ext.SpanKindRPCClient.Set(*clientSpan)
+	ext.HTTPUrl.Set(*clientSpan, url)
+	ext.HTTPMethod.Set(*clientSpan, "POST")
+
+	// Inject the client span context into the headers
+	(*tracer).Inject((*clientSpan).Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		observeDownstream(target, requestType, 0, time.Since(start))
+		log.Printf("Error calling %s %+v\n", url, err)
+		return nil, 0, hopErrorStatus(hopCtx, target, clientSpan)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		observeDownstream(target, requestType, resp.StatusCode, time.Since(start))
+		log.Printf("HTTP Error %d calling %s\n", resp.StatusCode, url)
+		if resp.StatusCode == http.StatusGatewayTimeout {
+			// the deadline passed further down the path
+			return nil, resp.StatusCode, http.StatusGatewayTimeout
+		}
+		return nil, resp.StatusCode, http.StatusBadGateway
+	}
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		observeDownstream(target, requestType, 0, time.Since(start))
+		log.Printf("Error reading the response of %s %+v\n", url, err)
+		return nil, 0, hopErrorStatus(hopCtx, target, clientSpan)
+	}
+	observeDownstream(target, requestType, resp.StatusCode, time.Since(start))
+	return responseBody, resp.StatusCode, http.StatusOK
+}
+
+// hopErrorStatus returns the status of a call to target that got no response:
+// 504 if the hop or the request timed out, 502 otherwise
+func hopErrorStatus(hopCtx context.Context, target string, span *opentracing.Span) int {
+	if timedOut(hopCtx) {
+		(*span).LogKV("event", "timeout", "target", target)
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func handleRequest(name string, requestType string, service *Service, topology *Topology) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
 		span, tracer := startSpan(name, requestType, &r.Header)
+		w, status, injected := injectFault(w, r, requestType, span)
+		if injected {
+			finishSpan(span, status, start)
+			return
+		}
 
-		target := getNextTarget(name, requestType)
+		hop := getNextTarget(topology, name, requestType)
 		w.Header().Set("Content-Type", "application/octet-stream")
 
-		body, httpStatus := callNext(target, requestType, service, w, &tracer, &span)
+		body, httpStatus := callHop(r.Context(), hop, requestType, service, w, &tracer, &span)
 		w.WriteHeader(httpStatus)
 		w.Write(body)
 		log.Printf("handling request %s\n", requestType)
-		defer span.Finish()
+		defer finishSpan(span, httpStatus, start)
 	}
 
 }
 
+// startSpan starts the server span of a request. A request carrying trace headers
+// continues the trace of its caller; any other request, or every request with
+// --root, starts a new trace, so any service can be an entry point
 func startSpan(name string, requestType string, header *http.Header) (opentracing.Span, opentracing.Tracer) {
 	var span opentracing.Span
 	tracer := opentracing.GlobalTracer()
-	if !root {
-		spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(*header))
+	spanCtx, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(*header))
+	if !root && err == nil && spanCtx != nil {
 		span = tracer.StartSpan(requestType, ext.RPCServerOption(spanCtx))
 	} else {
-		span = tracer.StartSpan(requestType)
+		span = tracer.StartSpan(requestType, ext.SpanKindRPCServer)
+		span.SetTag("entrypoint", true)
 	}
+	span.SetTag("path.id", requestType)
 
 	return span, tracer
 }
 
-func getNextTarget(currentNode string, requestType string) string {
-	nextNode := generatedRouteMap[requestType][currentNode]
-	return nextNode
+// finishSpan tags span with the response status and finishes it.
+// Spans that were not sampled are kept if they failed or were slow and the
+// sampling policy keeps those
+func finishSpan(span opentracing.Span, status int, start time.Time) {
+	if keep, reason := samplingPolicy.Keep(status, time.Since(start)); keep {
+		// sampling.priority goes first, the tracer drops the tags of unsampled spans
+		ext.SamplingPriority.Set(span, 1)
+		span.SetTag(samplingReasonTag, reason)
+	}
+	// status 0: the connection was dropped without an answer
+	if status > 0 {
+		ext.HTTPStatusCode.Set(span, uint16(status))
+	}
+	if status >= 500 {
+		ext.Error.Set(span, true)
+	}
+	span.Finish()
 }
 
+// getNextTarget returns the hop of currentNode on the path requestType
+func getNextTarget(topology *Topology, currentNode string, requestType string) Hop {
+	nextHop := topology.Paths[requestType][currentNode]
+	return nextHop
+}
+
+// callHop calls the targets drawn from hop in the order given by its mode.
+// A hop without targets processes the request as the last node of the path
+func callHop(ctx context.Context, hop Hop, requestType string, service *Service, w http.ResponseWriter, tracer *opentracing.Tracer, span *opentracing.Span) ([]byte, int) {
+	targets := hop.targets()
+	switch {
+	case len(targets) == 0:
+		return callNext(ctx, "", requestType, service, w.Header(), tracer, span)
+	case len(targets) == 1:
+		return callNext(ctx, targets[0], requestType, service, w.Header(), tracer, span)
+	case hop.mode() == hopParallel:
+		return callConcurrently(ctx, targets, requestType, service, w, tracer, span)
+	default:
+		return callSequentially(ctx, targets, requestType, service, w, tracer, span)
+	}
+}
+
+// healthz answers 200, or 503 once the service is shutting down
 func healthz() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if isDraining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -313,87 +689,147 @@ type Output struct {
 	target string
 	status int
 	body []byte
+	header http.Header
 }
 
-func callAllTargets(requestType string, service *Service, addrs []string) http.HandlerFunc {
+func callAllTargets(requestType string, service *Service, targets *Targets) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
 		span, tracer := startSpan(name, requestType, &r.Header)
+		w, status, injected := injectFault(w, r, requestType, span)
+		if injected {
+			finishSpan(span, status, start)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/octet-stream")
-		httpStatus := http.StatusOK
-		body := []byte{}
 
+		addrs := targets.List()
 		if len(addrs) == 0 {
 			addrs = []string{""}
 		}
 
-		count := len(addrs)
-		channel := make(chan Output, count)
-		var wg sync.WaitGroup
-		for _, target := range addrs {
-			wg.Add(1)
-			go func(ch chan Output, tg string) {
-				defer wg.Done()
-
-				log.Printf("calling --> %s", tg)
-				// add go routine to call next
-				auxBody, auxHttpStatus := callNext(tg, requestType, service, w, &tracer, &span)
-				output := Output{
-					target: tg,
-					status: auxHttpStatus,
-					body: auxBody,
-				}
-
-				ch <- output
-
-			}(channel, target)
+		body, httpStatus := callConcurrently(r.Context(), addrs, requestType, service, w, &tracer, &span)
+		if httpStatus != http.StatusOK {
+			w.WriteHeader(httpStatus)
+			w.Write([]byte{0})
+			defer finishSpan(span, httpStatus, start)
+			return
 		}
 
-		go func() {
-			wg.Wait()
-			close(channel)
-		}()
-
-		for output := range channel {
-			log.Printf("processing response from %s\n", output.target)
-			if output.status != http.StatusOK {
-				log.Printf("HTTP ERROR %d when calling %s\n", output.status, output.target)
-				w.WriteHeader(output.status)
-				w.Write([]byte{0})
-				defer span.Finish()
-				return
-			}
+		w.WriteHeader(httpStatus)
+		w.Write(body)
+		log.Printf("handling request to all children")
+		defer finishSpan(span, httpStatus, start)
+	}
 
-			body = append(body, output.body...)
-			log.Printf("processed %dB from %s\n", len(output.body), output.target)
+}
+
+// callConcurrently calls all addrs in parallel and concatenates their responses.
+// Once a call fails the others are cancelled, and the status of the first failed
+// call in addrs is returned. The headers of the calls are set on w once all of
+// them are done
+func callConcurrently(ctx context.Context, addrs []string, requestType string, service *Service, w http.ResponseWriter, tracer *opentracing.Tracer, span *opentracing.Span) ([]byte, int) {
+	body := []byte{}
+
+	// the calls still running are cancelled once one of them fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the status answered is the one of the first call to fail, the calls it
+	// cancelled fail after it
+	httpStatus := http.StatusOK
+	var failed sync.Once
+	outputs := make([]Output, len(addrs))
+	var wg sync.WaitGroup
+	for i, target := range addrs {
+		wg.Add(1)
+		go func(output *Output, tg string) {
+			defer wg.Done()
+
+			log.Printf("calling --> %s", tg)
+			// each call sets its own headers, w belongs to the handler
+			header := http.Header{}
+			auxBody, auxHttpStatus := callNext(ctx, tg, requestType, service, header, tracer, span)
+			*output = Output{
+				target: tg,
+				status: auxHttpStatus,
+				body: auxBody,
+				header: header,
+			}
+			if auxHttpStatus != http.StatusOK {
+				failed.Do(func() {
+					httpStatus = auxHttpStatus
+					cancel()
+				})
+			}
+		}(&outputs[i], target)
+	}
+	wg.Wait()
 
+	for _, output := range outputs {
+		for key, values := range output.header {
+			w.Header()[key] = values
+		}
+		log.Printf("processing response from %s\n", output.target)
+		if output.status != http.StatusOK {
+			log.Printf("HTTP ERROR %d when calling %s\n", output.status, output.target)
+			continue
 		}
 
-		w.WriteHeader(httpStatus)
-		w.Write(body)
-		log.Printf("handling request to all children")
-		defer span.Finish()
+		body = append(body, output.body...)
+		log.Printf("processed %dB from %s\n", len(output.body), output.target)
 	}
 
+	if httpStatus != http.StatusOK {
+		w.Header().Set("ST-Size-Bytes", "0")
+		return []byte{0}, httpStatus
+	}
+	w.Header().Set("ST-Size-Bytes", strconv.Itoa(len(body)))
+	return body, http.StatusOK
 }
 
-func callRandomTargets(requestType string, service *Service, addrs []string) http.HandlerFunc {
+// callSequentially calls addrs one after the other and concatenates their responses.
+// It stops at the first failed call, returning its status
+func callSequentially(ctx context.Context, addrs []string, requestType string, service *Service, w http.ResponseWriter, tracer *opentracing.Tracer, span *opentracing.Span) ([]byte, int) {
+	body := []byte{}
+
+	for _, target := range addrs {
+		log.Printf("calling --> %s", target)
+		auxBody, auxHttpStatus := callNext(ctx, target, requestType, service, w.Header(), tracer, span)
+		if auxHttpStatus != http.StatusOK {
+			log.Printf("HTTP ERROR %d when calling %s\n", auxHttpStatus, target)
+			return []byte{0}, auxHttpStatus
+		}
+		body = append(body, auxBody...)
+	}
+
+	return body, http.StatusOK
+}
+
+func callRandomTargets(requestType string, service *Service, targets *Targets) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
 		span, tracer := startSpan(name, requestType, &r.Header)
+		w, status, injected := injectFault(w, r, requestType, span)
+		if injected {
+			finishSpan(span, status, start)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/octet-stream")
 		httpStatus := http.StatusOK
 		body := []byte{}
 
-		target := randomSelection(addrs)
+		target := randomSelection(targets.List())
 
 		// add go routine to call next
-		auxBody, auxHttpStatus := callNext(target, requestType, service, w, &tracer, &span)
+		auxBody, auxHttpStatus := callNext(r.Context(), target, requestType, service, w.Header(), &tracer, &span)
 		if auxHttpStatus != http.StatusOK {
 			log.Printf("HTTP ERROR %d when calling %s\n", auxHttpStatus, target)
-			w.WriteHeader(httpStatus)
-			w.Write(body)
-			defer span.Finish()
+			w.WriteHeader(auxHttpStatus)
+			w.Write([]byte{0})
+			defer finishSpan(span, auxHttpStatus, start)
 			return
 		}
 
@@ -402,7 +838,7 @@ func callRandomTargets(requestType string, service *Service, addrs []string) htt
 		w.Write(body)
 
 		log.Printf("handling request to random %s", target)
-		defer span.Finish()
+		defer finishSpan(span, httpStatus, start)
 	}
 
 }
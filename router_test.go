@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestCallConcurrently(t *testing.T) {
+	tests := []struct {
+		name string
+		// answers maps the host called to its answer, 0 hangs until the call is cancelled
+		answers map[string]int
+		addrs   []string
+		status  int
+		body    string
+	}{
+		{
+			name:    "every call succeeds",
+			answers: map[string]int{"127.0.0.1": http.StatusOK, "localhost": http.StatusOK},
+			addrs:   []string{"127.0.0.1", "localhost"},
+			status:  http.StatusOK,
+			body:    "\x00ok\x00ok",
+		},
+		{
+			name:    "the first failure is answered, not the calls it cancelled",
+			answers: map[string]int{"127.0.0.1": 0, "localhost": http.StatusGatewayTimeout},
+			addrs:   []string{"127.0.0.1", "localhost"},
+			status:  http.StatusGatewayTimeout,
+			body:    "\x00",
+		},
+	}
+
+	service := &Service{ID: "svc-0"}
+	var err error
+	if service.ProcessTimes, err = newDistributions(map[string]string{"": "constant"}, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if service.MessageSizes, err = newDistributions(map[string]string{"": "constant"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	defer func(port string) { globalPort = port }(globalPort)
+	tracer := opentracing.Tracer(opentracing.NoopTracer{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				host, _, _ := net.SplitHostPort(r.Host)
+				switch status := test.answers[host]; status {
+				case 0:
+					<-r.Context().Done()
+				case http.StatusOK:
+					w.Write([]byte("ok"))
+				default:
+					// the sibling calls are in flight when this one fails
+					time.Sleep(20 * time.Millisecond)
+					w.WriteHeader(status)
+				}
+			}))
+			defer server.Close()
+			_, globalPort, _ = net.SplitHostPort(server.Listener.Addr().String())
+
+			span := tracer.StartSpan("test")
+			w := httptest.NewRecorder()
+			body, status := callConcurrently(context.Background(), test.addrs, "0", service, w, &tracer, &span)
+			if status != test.status {
+				t.Errorf("status = %d, want %d", status, test.status)
+			}
+			// each call sends a body of one byte and appends the response to it
+			if string(body) != test.body {
+				t.Errorf("body = %q, want %q", body, test.body)
+			}
+		})
+	}
+}
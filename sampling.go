@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	samplingAlways        = "always"
+	samplingNever         = "never"
+	samplingProbabilistic = "probabilistic"
+	samplingRateLimiting  = "ratelimiting"
+
+	// tags recording why a span was kept
+	samplingRuleTag   = "sampling.rule"
+	samplingReasonTag = "sampling.reason"
+)
+
+// headSampler decides whether a new trace is recorded
+type headSampler interface {
+	Sample() bool
+	String() string
+}
+
+// newHeadSampler builds a sampler from a spec of the form name[:key=value]:
+//
+//	always                    every trace
+//	never                     no trace
+//	probabilistic:p=0.01      a fraction p of the traces
+//	ratelimiting:tps=10       at most tps traces per second
+//
+// A bare number is a shorthand for probabilistic:p=number.
+func newHeadSampler(spec string) (headSampler, error) {
+	if p, err := strconv.ParseFloat(spec, 64); err == nil {
+		return newProbabilisticSampler(spec, p)
+	}
+
+	name, params, err := parseDistributionSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case samplingAlways:
+		return constSampler{spec: spec, sample: true}, nil
+	case samplingNever:
+		return constSampler{spec: spec, sample: false}, nil
+	case samplingProbabilistic:
+		p, err := strconv.ParseFloat(params["p"], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: p must be a number", spec)
+		}
+		return newProbabilisticSampler(spec, p)
+	case samplingRateLimiting:
+		tps, err := strconv.ParseFloat(params["tps"], 64)
+		if err != nil || tps < 0 {
+			return nil, fmt.Errorf("%s: tps must be a positive number", spec)
+		}
+		return &rateLimitingSampler{spec: spec, limiter: rate.NewLimiter(rate.Limit(tps), 1)}, nil
+	}
+	return nil, fmt.Errorf("unknown sampler %s", name)
+}
+
+type constSampler struct {
+	spec   string
+	sample bool
+}
+
+func (s constSampler) Sample() bool   { return s.sample }
+func (s constSampler) String() string { return s.spec }
+
+type probabilisticSampler struct {
+	spec string
+	p    float64
+}
+
+func newProbabilisticSampler(spec string, p float64) (headSampler, error) {
+	if p < 0 || p > 1 {
+		return nil, fmt.Errorf("%s: probability must be in [0, 1]", spec)
+	}
+	return &probabilisticSampler{spec: spec, p: p}, nil
+}
+
+func (s *probabilisticSampler) Sample() bool   { return rand.Float64() < s.p }
+func (s *probabilisticSampler) String() string { return s.spec }
+
+type rateLimitingSampler struct {
+	spec    string
+	limiter *rate.Limiter
+}
+
+func (s *rateLimitingSampler) Sample() bool   { return s.limiter.Allow() }
+func (s *rateLimitingSampler) String() string { return s.spec }
+
+// SamplingPolicy decides which traces are recorded.
+// The traces a service starts are sampled by the sampler of their endpoint, or the
+// service default; a service that receives a trace follows the decision of its caller.
+// Spans that were not sampled are kept anyway when they fail or are slow, if enabled.
+type SamplingPolicy struct {
+	byEndpoint map[string]headSampler
+	errors     bool
+	slow       time.Duration
+}
+
+/**
+* newSamplingPolicy returns the policy of the service
+* @param specs the sampler specs, the service default under "" and per endpoint overrides
+* @param errors whether spans answered with a 5xx status code are kept
+* @param slow spans lasting longer are kept, 0 keeps none
+**/
+func newSamplingPolicy(specs endpointSpecFlag, errors bool, slow time.Duration) (*SamplingPolicy, error) {
+	p := &SamplingPolicy{byEndpoint: make(map[string]headSampler, len(specs)), errors: errors, slow: slow}
+	for endpoint, spec := range specs {
+		sampler, err := newHeadSampler(spec)
+		if err != nil {
+			return nil, err
+		}
+		p.byEndpoint[endpoint] = sampler
+	}
+	return p, nil
+}
+
+// Sample decides whether a trace started on endpoint is recorded and returns
+// the rule that decided it
+func (p *SamplingPolicy) Sample(endpoint string) (bool, string) {
+	if sampler, ok := p.byEndpoint[endpoint]; ok {
+		return sampler.Sample(), "/" + endpoint + "=" + sampler.String()
+	}
+	sampler := p.byEndpoint[""]
+	return sampler.Sample(), sampler.String()
+}
+
+// Tail reports whether spans that were not sampled may still be kept when they finish
+func (p *SamplingPolicy) Tail() bool {
+	return p.errors || p.slow > 0
+}
+
+// Keep decides whether a finished span is kept regardless of the head decision,
+// and returns why: error or slow. Status 0 is a request dropped without an answer.
+func (p *SamplingPolicy) Keep(status int, elapsed time.Duration) (bool, string) {
+	if p.errors && (status >= 500 || status == 0) {
+		return true, "error"
+	}
+	if p.slow > 0 && elapsed > p.slow {
+		return true, "slow"
+	}
+	return false, ""
+}
+
+// PerEndpoint reports whether some endpoint overrides the default sampler
+func (p *SamplingPolicy) PerEndpoint() bool {
+	return len(p.byEndpoint) > 1
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHeadSampler(t *testing.T) {
+	tests := []struct {
+		spec string
+		// sampled is the number of traces out of 1000 sampled, within tolerance
+		sampled   int
+		tolerance int
+		err       string
+	}{
+		{spec: "always", sampled: 1000},
+		{spec: "never", sampled: 0},
+		{spec: "probabilistic:p=0.25", sampled: 250, tolerance: 60},
+		{spec: "0.5", sampled: 500, tolerance: 70},
+		{spec: "0", sampled: 0},
+		// the burst of one trace, then no time passes for another token
+		{spec: "ratelimiting:tps=0.001", sampled: 1},
+		{spec: "probabilistic:p=2", err: "probability must be in [0, 1]"},
+		{spec: "-0.1", err: "probability must be in [0, 1]"},
+		{spec: "probabilistic", err: "p must be a number"},
+		{spec: "ratelimiting:tps=-1", err: "tps must be a positive number"},
+		{spec: "adaptive", err: "unknown sampler adaptive"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			sampler, err := newHeadSampler(test.spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("newHeadSampler(%s) error = %v, want %q", test.spec, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newHeadSampler(%s) error = %v", test.spec, err)
+			}
+			if sampler.String() != test.spec {
+				t.Errorf("String() = %s, want %s", sampler.String(), test.spec)
+			}
+
+			sampled := 0
+			for i := 0; i < 1000; i++ {
+				if sampler.Sample() {
+					sampled++
+				}
+			}
+			if sampled < test.sampled-test.tolerance || sampled > test.sampled+test.tolerance {
+				t.Errorf("sampled %d of 1000 traces, want %d ± %d", sampled, test.sampled, test.tolerance)
+			}
+		})
+	}
+}
+
+func TestSamplingPolicySample(t *testing.T) {
+	policy, err := newSamplingPolicy(map[string]string{"": "never", "0": "always"}, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.PerEndpoint() {
+		t.Error("PerEndpoint() = false with an override for /0")
+	}
+
+	tests := []struct {
+		endpoint string
+		sampled  bool
+		rule     string
+	}{
+		{endpoint: "0", sampled: true, rule: "/0=always"},
+		{endpoint: "all", sampled: false, rule: "never"},
+		{endpoint: "random", sampled: false, rule: "never"},
+	}
+	for _, test := range tests {
+		if sampled, rule := policy.Sample(test.endpoint); sampled != test.sampled || rule != test.rule {
+			t.Errorf("Sample(%s) = %t, %s, want %t, %s", test.endpoint, sampled, rule, test.sampled, test.rule)
+		}
+	}
+
+	if _, err := newSamplingPolicy(map[string]string{"": "always", "0": "sometimes"}, false, 0); err == nil {
+		t.Error("newSamplingPolicy() with an unknown sampler returned no error")
+	}
+}
+
+func TestSamplingPolicyKeep(t *testing.T) {
+	tests := []struct {
+		name    string
+		errors  bool
+		slow    time.Duration
+		status  int
+		elapsed time.Duration
+		keep    bool
+		reason  string
+	}{
+		{name: "no tail sampling", status: 500, elapsed: time.Hour},
+		{name: "error kept", errors: true, status: 500, keep: true, reason: "error"},
+		{name: "503 kept", errors: true, status: 503, keep: true, reason: "error"},
+		{name: "client error dropped", errors: true, status: 404},
+		{name: "success dropped", errors: true, status: 200, elapsed: time.Hour},
+		{name: "slow kept", slow: time.Second, status: 200, elapsed: 2 * time.Second, keep: true, reason: "slow"},
+		{name: "fast dropped", slow: time.Second, status: 200, elapsed: time.Second},
+		{name: "slow error kept as error", errors: true, slow: time.Second, status: 502, elapsed: time.Minute, keep: true, reason: "error"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := newSamplingPolicy(map[string]string{"": "never"}, test.errors, test.slow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tail := policy.Tail(); tail != (test.errors || test.slow > 0) {
+				t.Errorf("Tail() = %t", tail)
+			}
+			if keep, reason := policy.Keep(test.status, test.elapsed); keep != test.keep || reason != test.reason {
+				t.Errorf("Keep(%d, %s) = %t, %q, want %t, %q", test.status, test.elapsed, keep, reason, test.keep, test.reason)
+			}
+		})
+	}
+}
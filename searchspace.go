@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	parameterInteger = "integer"
+	parameterReal    = "real"
+)
+
+var printSearchSpace bool
+
+// ParameterRange is an interval of valid values, with the step between two
+// values for a discrete interval
+type ParameterRange struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+	Step  float64 `json:"step,omitempty"`
+}
+
+// ParameterSpace describes a tunable parameter: a value is valid if it is in
+// one of the ranges or one of the categorical values
+type ParameterSpace struct {
+	Name    string           `json:"name"`
+	Type    string           `json:"type"`
+	Ranges  []ParameterRange `json:"ranges,omitempty"`
+	Values  []float64        `json:"values,omitempty"`
+	Current float64          `json:"current"`
+	// UsedBy lists the functions deriving the coordinates from the parameter
+	UsedBy []string `json:"usedBy"`
+}
+
+// SearchSpace is the space of the parameters exposed on /admin/searchspace,
+// with the objective functions of the coordinates they give
+type SearchSpace struct {
+	Parameters []ParameterSpace      `json:"parameters"`
+	Functions  map[string]*Objective `json:"functions"`
+}
+
+// parameterSpace is the definition of a parameter: its valid values and the
+// field of Parameters holding it
+type parameterSpace struct {
+	ParameterSpace
+	field int
+}
+
+// parameterSpaces are the a..h, x, y parameters in the order of Parameters
+var parameterSpaces = newParameterSpaces()
+
+// newParameterSpaces derives the definition of every parameter from the domain
+// tag of its field in Parameters and from the coordinate functions using it
+func newParameterSpaces() []parameterSpace {
+	fields := reflect.TypeOf(Parameters{})
+	spaces := make([]parameterSpace, 0, fields.NumField())
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		parameter := ParameterSpace{Name: field.Tag.Get("json"), Type: parameterReal, UsedBy: []string{}}
+		if field.Type.Kind() == reflect.Int {
+			parameter.Type = parameterInteger
+		}
+		for _, domain := range strings.Fields(field.Tag.Get("domain")) {
+			bounds := make([]float64, 0, 3)
+			for _, bound := range strings.Split(domain, ":") {
+				value, err := strconv.ParseFloat(bound, 64)
+				if err != nil {
+					panic(fmt.Sprintf("domain of parameter %s: %v", parameter.Name, err))
+				}
+				bounds = append(bounds, value)
+			}
+			switch len(bounds) {
+			case 1:
+				parameter.Values = append(parameter.Values, bounds[0])
+			case 2:
+				parameter.Ranges = append(parameter.Ranges, ParameterRange{Lower: bounds[0], Upper: bounds[1]})
+			default:
+				parameter.Ranges = append(parameter.Ranges, ParameterRange{Lower: bounds[0], Upper: bounds[1], Step: bounds[2]})
+			}
+		}
+		for _, function := range coordinateFunctions {
+			for _, name := range function.parameters {
+				if name == parameter.Name {
+					parameter.UsedBy = append(parameter.UsedBy, function.name)
+				}
+			}
+		}
+		spaces = append(spaces, parameterSpace{ParameterSpace: parameter, field: i})
+	}
+	return spaces
+}
+
+// value returns the value of the parameter in p
+func (s parameterSpace) value(p Parameters) float64 {
+	field := reflect.ValueOf(p).Field(s.field)
+	if field.Kind() == reflect.Int {
+		return float64(field.Int())
+	}
+	return field.Float()
+}
+
+// set makes value the value of the parameter in p, integers are truncated
+func (s parameterSpace) set(p *Parameters, value float64) {
+	field := reflect.ValueOf(p).Elem().Field(s.field)
+	if field.Kind() == reflect.Int {
+		field.SetInt(int64(value))
+		return
+	}
+	field.SetFloat(value)
+}
+
+// newSearchSpace returns the space of the parameters with their values in params
+func newSearchSpace(params Parameters) SearchSpace {
+	space := SearchSpace{
+		Parameters: make([]ParameterSpace, 0, len(parameterSpaces)),
+		Functions:  selectedObjectives(),
+	}
+	for _, definition := range parameterSpaces {
+		parameter := definition.ParameterSpace
+		parameter.Current = definition.value(params)
+		space.Parameters = append(space.Parameters, parameter)
+	}
+	return space
+}
+
+// writeSearchSpace writes space as indented JSON, as printed by --print-searchspace
+func writeSearchSpace(w io.Writer, space SearchSpace) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(space)
+}
+
+// registerAdminSearchSpace adds the search space of the parameters to r:
+//
+//	GET    /admin/searchspace              tunable parameters with their valid values and current value
+func registerAdminSearchSpace(r *mux.Router, tuner *Tuner) {
+	r.Methods("GET").Path("/admin/searchspace").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newSearchSpace(tuner.Parameters()))
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParameterSpaces(t *testing.T) {
+	tests := []struct {
+		name   string
+		kind   string
+		ranges []ParameterRange
+		values []float64
+		usedBy []string
+	}{
+		{name: "x", kind: parameterInteger, ranges: []ParameterRange{{Lower: -3, Upper: 3, Step: 1}}, usedBy: []string{"x_1", "x_2"}},
+		{name: "y", kind: parameterInteger, ranges: []ParameterRange{{Lower: -3, Upper: 3, Step: 1}}, usedBy: []string{"y_1", "y_2"}},
+		{name: "a", kind: parameterReal, ranges: []ParameterRange{{Lower: -4, Upper: 4}}, usedBy: []string{"x_1", "y_1"}},
+		{name: "b", kind: parameterReal, ranges: []ParameterRange{{Lower: -250, Upper: 250}}, usedBy: []string{"x_1", "y_2"}},
+		{name: "c", kind: parameterReal, ranges: []ParameterRange{{Lower: -10, Upper: 10}}, usedBy: []string{"x_1", "y_1"}},
+		{name: "d", kind: parameterReal, ranges: []ParameterRange{{Lower: 1e-5, Upper: 1e-1}}, values: []float64{10, 100, 1000, 10000, 100000}, usedBy: []string{"x_1", "x_2"}},
+		{name: "e", kind: parameterReal, ranges: []ParameterRange{{Lower: -2.5, Upper: 2.5}}, usedBy: []string{"x_2", "y_1", "y_2"}},
+		{name: "f", kind: parameterReal, ranges: []ParameterRange{{Lower: -10, Upper: -5}, {Lower: 5, Upper: 10}}, usedBy: []string{"y_1", "y_2"}},
+		{name: "g", kind: parameterReal, ranges: []ParameterRange{{Lower: -3, Upper: 3}}, usedBy: []string{"y_1"}},
+		{name: "h", kind: parameterReal, ranges: []ParameterRange{{Lower: -25, Upper: 25}}, usedBy: []string{"x_2"}},
+	}
+
+	if len(parameterSpaces) != len(tests) {
+		t.Fatalf("%d parameters, want %d", len(parameterSpaces), len(tests))
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parameter := parameterSpaces[i].ParameterSpace
+			if parameter.Name != test.name || parameter.Type != test.kind {
+				t.Errorf("parameter %d = %s %s, want %s %s", i, parameter.Name, parameter.Type, test.name, test.kind)
+			}
+			if !reflect.DeepEqual(parameter.Ranges, test.ranges) || !reflect.DeepEqual(parameter.Values, test.values) {
+				t.Errorf("domain = %v %v, want %v %v", parameter.Ranges, parameter.Values, test.ranges, test.values)
+			}
+			if !reflect.DeepEqual(parameter.UsedBy, test.usedBy) {
+				t.Errorf("usedBy = %v, want %v", parameter.UsedBy, test.usedBy)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	shutdownDelay time.Duration
+	shutdownGrace time.Duration
+	// draining is 1 once the service is shutting down
+	draining int32
+)
+
+// isDraining reports whether the service is shutting down, /health then fails
+// so the service is taken out of the load balancer
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+/**
+* serveUntilTerminated serves srv until the process receives SIGTERM or SIGINT, then shuts down:
+* /health fails for delay while the service is removed from the load balancer,
+* the requests in flight have grace to finish before their connections are closed,
+* and closers flush the tracer and the metrics exporters
+* @param srv the server of the service
+* @param delay the time /health fails before the server stops accepting connections
+* @param grace the time the requests in flight have to finish
+* @param closers the exporters flushed once the server is stopped, in order
+* @return the error that stopped the server, nil once it is shut down
+ */
+func serveUntilTerminated(srv *http.Server, delay time.Duration, grace time.Duration, closers []io.Closer) error {
+	terminated := make(chan os.Signal, 1)
+	signal.Notify(terminated, syscall.SIGTERM, syscall.SIGINT)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		// the server could not start, the exporters are flushed all the same
+		closeAll(closers)
+		removePid()
+		return err
+	case sig := <-terminated:
+		log.Printf("%v received, draining for %v\n", sig, delay)
+	}
+
+	atomic.StoreInt32(&draining, 1)
+	time.Sleep(delay)
+
+	log.Printf("shutting down, waiting up to %v for the requests in flight\n", grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("requests still in flight after %v, closing their connections: %v\n", grace, err)
+		srv.Close()
+	}
+	if err := <-serveErr; err != http.ErrServerClosed {
+		log.Printf("server stopped: %v\n", err)
+	}
+
+	closeAll(closers)
+	removePid()
+	log.Printf("shut down\n")
+	return nil
+}
+
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			log.Printf("error flushing: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// recordingCloser appends its name to closed when it is closed
+type recordingCloser struct {
+	name   string
+	mux    *sync.Mutex
+	closed *[]string
+}
+
+func (c recordingCloser) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	*c.closed = append(*c.closed, c.name)
+	return nil
+}
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// waitHealth polls /health of addr until it answers status
+func waitHealth(t *testing.T, addr string, status int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		resp, err := http.Get("http://" + addr + "/health")
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == status {
+			return
+		}
+	}
+	t.Fatalf("/health never answered %d", status)
+}
+
+func TestServeUntilTerminated(t *testing.T) {
+	tests := []struct {
+		name  string
+		grace time.Duration
+		// finishes reports whether the request in flight finishes within grace
+		finishes bool
+	}{
+		{name: "requests in flight finish", grace: 5 * time.Second, finishes: true},
+		{name: "requests over the grace are dropped", grace: 50 * time.Millisecond, finishes: false},
+	}
+
+	defer atomic.StoreInt32(&draining, 0)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&draining, 0)
+			addr := freeAddr(t)
+			started := make(chan struct{})
+			release := make(chan struct{})
+			mux := http.NewServeMux()
+			mux.HandleFunc("/health", healthz())
+			mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+			srv := &http.Server{Addr: addr, Handler: mux}
+
+			closedMux := &sync.Mutex{}
+			closed := []string{}
+			closers := []io.Closer{
+				recordingCloser{name: "tracer", mux: closedMux, closed: &closed},
+				recordingCloser{name: "metrics", mux: closedMux, closed: &closed},
+			}
+			done := make(chan struct{})
+			go func() {
+				serveUntilTerminated(srv, 200*time.Millisecond, test.grace, closers)
+				close(done)
+			}()
+			// the server is up, so SIGTERM is caught by serveUntilTerminated
+			waitHealth(t, addr, http.StatusOK)
+
+			inFlight := make(chan error, 1)
+			go func() {
+				resp, err := http.Get("http://" + addr + "/slow")
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						err = errors.New(resp.Status)
+					}
+				}
+				inFlight <- err
+			}()
+			<-started
+
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				t.Fatal(err)
+			}
+			// /health fails while the service is taken out of the load balancer
+			waitHealth(t, addr, http.StatusServiceUnavailable)
+
+			if test.finishes {
+				// the server stops accepting connections, the request in flight has time to finish
+				time.Sleep(300 * time.Millisecond)
+				close(release)
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("serveUntilTerminated did not return")
+			}
+			if err := <-inFlight; (err == nil) != test.finishes {
+				t.Errorf("request in flight error = %v, want it to finish: %v", err, test.finishes)
+			}
+			if !test.finishes {
+				close(release)
+			}
+
+			if _, err := http.Get("http://" + addr + "/health"); err == nil {
+				t.Error("the server still accepts connections after shutting down")
+			}
+			if len(closed) != 2 || closed[0] != "tracer" || closed[1] != "metrics" {
+				t.Errorf("closed %v, want the tracer then the metrics", closed)
+			}
+		})
+	}
+}
+
+func TestServeUntilTerminatedServeError(t *testing.T) {
+	// the address is taken, so the server cannot start
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	closedMux := &sync.Mutex{}
+	closed := []string{}
+	srv := &http.Server{Addr: listener.Addr().String(), Handler: http.NewServeMux()}
+	err = serveUntilTerminated(srv, time.Second, time.Second, []io.Closer{recordingCloser{name: "tracer", mux: closedMux, closed: &closed}})
+	if err == nil || err == http.ErrServerClosed {
+		t.Errorf("serveUntilTerminated() error = %v, want the listen error", err)
+	}
+	if len(closed) != 1 {
+		t.Errorf("closed %v, want the tracer flushed all the same", closed)
+	}
+}
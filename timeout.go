@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeoutHeader carries the milliseconds left to answer a request.
+// Every hop sends what is left of its own deadline, so the budget shrinks along the path
+const timeoutHeader = "ST-Timeout-Ms"
+
+var (
+	requestTimeout time.Duration
+	hopTimeouts    = timeoutFlag{}
+)
+
+// withDeadline bounds the requests to next by the time left in their timeoutHeader,
+// or by requestTimeout for requests arriving without one. A request whose budget is
+// already spent is answered 504 without calling next. The context of the
+// request is cancelled when the deadline passes or the client goes away.
+func withDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := requestTimeout
+		if ms, err := strconv.ParseInt(r.Header.Get(timeoutHeader), 10, 64); err == nil {
+			if ms <= 0 {
+				w.WriteHeader(http.StatusGatewayTimeout)
+				w.Write([]byte{0})
+				return
+			}
+			if left := time.Duration(ms) * time.Millisecond; timeout <= 0 || left < timeout {
+				timeout = left
+			}
+		}
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hopContext bounds a call to target by its hop timeout, on top of the deadline of ctx
+func hopContext(ctx context.Context, target string) (context.Context, context.CancelFunc) {
+	if timeout := hopTimeouts.get(target); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// setTimeoutHeader tells the next hop how long it has left, if ctx has a deadline
+func setTimeoutHeader(ctx context.Context, header http.Header) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	left := time.Until(deadline).Milliseconds()
+	if left < 0 {
+		left = 0
+	}
+	header.Set(timeoutHeader, strconv.FormatInt(left, 10))
+}
+
+// timedOut reports whether ctx ended because its deadline passed
+func timedOut(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// timeoutFlag collects the hop timeouts given on the command line.
+// A plain duration is the timeout of every call; target=duration overrides it
+// for the calls to one downstream service, e.g. svc-1-mock=200ms.
+type timeoutFlag map[string]time.Duration
+
+func (f timeoutFlag) get(target string) time.Duration {
+	if timeout, ok := f[target]; ok {
+		return timeout
+	}
+	return f[""]
+}
+
+func (f timeoutFlag) String() string {
+	timeouts := make([]string, 0, len(f))
+	for target, timeout := range f {
+		if target == "" {
+			timeouts = append(timeouts, timeout.String())
+		} else {
+			timeouts = append(timeouts, target+"="+timeout.String())
+		}
+	}
+	sort.Strings(timeouts)
+	return strings.Join(timeouts, " ")
+}
+
+func (f timeoutFlag) Set(value string) error {
+	target := ""
+	if kv := strings.SplitN(value, "=", 2); len(kv) == 2 {
+		target, value = kv[0], kv[1]
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	f[target] = timeout
+	return nil
+}
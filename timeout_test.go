@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWithDeadline(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestTimeout time.Duration
+		// header is the value of timeoutHeader, "" leaves it out
+		header string
+		status int
+		called bool
+		// deadline is the time the request has, 0 for no deadline
+		deadline time.Duration
+	}{
+		{name: "no header, no default", status: http.StatusOK, called: true},
+		{name: "no header falls back to the default", requestTimeout: time.Minute, status: http.StatusOK, called: true, deadline: time.Minute},
+		{name: "header without default", header: "30000", status: http.StatusOK, called: true, deadline: 30 * time.Second},
+		{name: "header shorter than the default", requestTimeout: time.Minute, header: "30000", status: http.StatusOK, called: true, deadline: 30 * time.Second},
+		{name: "default shorter than the header", requestTimeout: 30 * time.Second, header: "60000", status: http.StatusOK, called: true, deadline: 30 * time.Second},
+		{name: "malformed header falls back to the default", requestTimeout: time.Minute, header: "soon", status: http.StatusOK, called: true, deadline: time.Minute},
+		{name: "no time left", requestTimeout: time.Minute, header: "0", status: http.StatusGatewayTimeout},
+		{name: "budget spent", header: "-5", status: http.StatusGatewayTimeout},
+	}
+
+	defer func(timeout time.Duration) { requestTimeout = timeout }(requestTimeout)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestTimeout = test.requestTimeout
+
+			called := false
+			var deadline time.Time
+			var hasDeadline bool
+			handler := withDeadline(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				deadline, hasDeadline = r.Context().Deadline()
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			r := httptest.NewRequest("POST", "/0", nil)
+			if test.header != "" {
+				r.Header.Set(timeoutHeader, test.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if called != test.called {
+				t.Fatalf("next called = %v, want %v", called, test.called)
+			}
+			if !called {
+				return
+			}
+			if hasDeadline != (test.deadline > 0) {
+				t.Fatalf("request has a deadline = %v, want %v", hasDeadline, test.deadline > 0)
+			}
+			if left := time.Until(deadline); hasDeadline && (left > test.deadline || left < test.deadline-time.Second) {
+				t.Errorf("deadline in %v, want %v", left, test.deadline)
+			}
+		})
+	}
+}
+
+func TestSetTimeoutHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    func() (context.Context, context.CancelFunc)
+		header bool
+		// max is the largest value expected in the header, in milliseconds
+		max int64
+	}{
+		{
+			name:   "no deadline",
+			ctx:    func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			header: false,
+		},
+		{
+			name: "time left",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Minute)
+			},
+			header: true,
+			max:    60000,
+		},
+		{
+			name: "deadline passed",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+			},
+			header: true,
+			max:    0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := test.ctx()
+			defer cancel()
+
+			header := http.Header{}
+			setTimeoutHeader(ctx, header)
+			value := header.Get(timeoutHeader)
+			if (value != "") != test.header {
+				t.Fatalf("%s = %q, want it set: %v", timeoutHeader, value, test.header)
+			}
+			if !test.header {
+				return
+			}
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || ms < 0 || ms > test.max || ms < test.max-1000 {
+				t.Errorf("%s = %q, want %d ms at most", timeoutHeader, value, test.max)
+			}
+		})
+	}
+}
+
+func TestHopContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts []string
+		target   string
+		timeout  time.Duration
+	}{
+		{name: "no hop timeout", target: "svc-1"},
+		{name: "timeout of every call", timeouts: []string{"200ms"}, target: "svc-1", timeout: 200 * time.Millisecond},
+		{name: "timeout of one target", timeouts: []string{"200ms", "svc-1=50ms"}, target: "svc-1", timeout: 50 * time.Millisecond},
+		{name: "other targets keep the default", timeouts: []string{"200ms", "svc-1=50ms"}, target: "svc-2", timeout: 200 * time.Millisecond},
+	}
+
+	defer func(timeouts timeoutFlag) { hopTimeouts = timeouts }(hopTimeouts)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hopTimeouts = timeoutFlag{}
+			for _, value := range test.timeouts {
+				if err := hopTimeouts.Set(value); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := hopContext(context.Background(), test.target)
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			if ok != (test.timeout > 0) {
+				t.Fatalf("hop has a deadline = %v, want %v", ok, test.timeout > 0)
+			}
+			if left := time.Until(deadline); ok && (left > test.timeout || left < test.timeout-10*time.Millisecond) {
+				t.Errorf("hop deadline in %v, want %v", left, test.timeout)
+			}
+		})
+	}
+}
+
+func TestTimeoutFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		err   bool
+	}{
+		{value: "100ms"},
+		{value: "svc-1=2s"},
+		{value: "0"},
+		{value: "-1s", err: true},
+		{value: "svc-1=soon", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if err := (timeoutFlag{}).Set(test.value); (err != nil) != test.err {
+				t.Errorf("Set(%s) error = %v, want an error: %v", test.value, err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+)
+
+// Topology describes the call graph served by the microservice.
+// Paths maps a path id (exposed as the endpoint /<pathId>) to the hop of
+// every node along that path, see Hop. The last node of a path calls no one.
+// Services optionally declares every node allowed to appear in Paths.
+// Faults are injected into the requests of the nodes they name, see Fault.
+type Topology struct {
+	Services []string                  `json:"services,omitempty" yaml:"services,omitempty"`
+	Paths    map[string]map[string]Hop `json:"paths" yaml:"paths"`
+	Faults   []Fault                   `json:"faults,omitempty" yaml:"faults,omitempty"`
+}
+
+// loadTopology reads a topology from a JSON (.json) or YAML file and validates it
+func loadTopology(filename string) (*Topology, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	topology := &Topology{}
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		err = json.Unmarshal(data, topology)
+	} else {
+		err = yaml.Unmarshal(data, topology)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing topology %s: %v", filename, err)
+	}
+
+	if err := topology.validate(); err != nil {
+		return nil, fmt.Errorf("invalid topology %s: %v", filename, err)
+	}
+	return topology, nil
+}
+
+// validate checks that every path only references known nodes, has no cycles
+// and ends in a terminal node
+func (t *Topology) validate() error {
+	if len(t.Paths) == 0 {
+		return fmt.Errorf("no paths defined")
+	}
+
+	known := make(map[string]bool, len(t.Services))
+	for _, svc := range t.Services {
+		known[svc] = true
+	}
+
+	for _, pathId := range t.pathIds() {
+		route := t.Paths[pathId]
+		if len(route) == 0 {
+			return fmt.Errorf("path %s: no nodes defined", pathId)
+		}
+
+		terminal := false
+		for node, hop := range route {
+			if node == "" {
+				return fmt.Errorf("path %s: empty node name", pathId)
+			}
+			if len(known) > 0 && !known[node] {
+				return fmt.Errorf("path %s: unknown node %s", pathId, node)
+			}
+			if err := hop.validate(); err != nil {
+				return fmt.Errorf("path %s: node %s: %v", pathId, node, err)
+			}
+			if len(hop.Calls) == 0 {
+				terminal = true
+			}
+			for _, call := range hop.Calls {
+				if _, ok := route[call.Target]; !ok {
+					return fmt.Errorf("path %s: node %s calls unknown node %s", pathId, node, call.Target)
+				}
+			}
+		}
+		if !terminal {
+			return fmt.Errorf("path %s: missing terminal node", pathId)
+		}
+
+		if node := findCycle(route); node != "" {
+			return fmt.Errorf("path %s: cycle through node %s", pathId, node)
+		}
+	}
+
+	for i := range t.Faults {
+		if err := t.Faults[i].validate(); err != nil {
+			return err
+		}
+		if service := t.Faults[i].Service; service != "" && len(known) > 0 && !known[service] {
+			return fmt.Errorf("fault %s: unknown service %s", t.Faults[i].Type, service)
+		}
+	}
+	return nil
+}
+
+// findCycle returns a node on a cycle of route, or "" if route is acyclic
+func findCycle(route map[string]Hop) string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(route))
+
+	var visit func(node string) string
+	visit = func(node string) string {
+		switch state[node] {
+		case visiting:
+			return node
+		case visited:
+			return ""
+		}
+		state[node] = visiting
+		for _, call := range route[node].Calls {
+			if cycle := visit(call.Target); cycle != "" {
+				return cycle
+			}
+		}
+		state[node] = visited
+		return ""
+	}
+
+	for node := range route {
+		if cycle := visit(node); cycle != "" {
+			return cycle
+		}
+	}
+	return ""
+}
+
+// clone returns a deep copy of the topology
+func (t *Topology) clone() *Topology {
+	clone := &Topology{
+		Services: append([]string(nil), t.Services...),
+		Paths:    make(map[string]map[string]Hop, len(t.Paths)),
+		Faults:   append([]Fault(nil), t.Faults...),
+	}
+	for pathId, route := range t.Paths {
+		clone.Paths[pathId] = make(map[string]Hop, len(route))
+		for node, hop := range route {
+			clone.Paths[pathId][node] = hop.clone()
+		}
+	}
+	return clone
+}
+
+// pathIds returns the path ids sorted so endpoints are registered in a stable order
+func (t *Topology) pathIds() []string {
+	ids := make([]string, 0, len(t.Paths))
+	for id := range t.Paths {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// pathTable couples a topology with the router serving its /<pathId> endpoints
+type pathTable struct {
+	topology *Topology
+	router   *mux.Router
+}
+
+// PathRoutes serves the /<pathId> endpoints of the current topology.
+// The topology and its router are replaced together, so requests already
+// routed keep using the map they started with while new requests use the new one.
+type PathRoutes struct {
+	current atomic.Value // *pathTable
+	mux     sync.Mutex   // serializes updates
+	handler func(topology *Topology, pathId string) http.HandlerFunc
+}
+
+func NewPathRoutes(topology *Topology, handler func(topology *Topology, pathId string) http.HandlerFunc) *PathRoutes {
+	routes := &PathRoutes{handler: handler}
+	routes.Set(topology)
+	return routes
+}
+
+// Topology returns the topology currently served
+func (p *PathRoutes) Topology() *Topology {
+	return p.current.Load().(*pathTable).topology
+}
+
+// Set atomically replaces the served topology, registering the endpoints of
+// new paths and dropping the endpoints of removed ones
+func (p *PathRoutes) Set(topology *Topology) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.set(topology)
+}
+
+// Update applies fn to a copy of the served topology and serves the result if
+// it is valid. Concurrent updates are applied one after the other.
+func (p *PathRoutes) Update(fn func(topology *Topology) error) (*Topology, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	topology := p.Topology().clone()
+	if err := fn(topology); err != nil {
+		return nil, err
+	}
+	if err := topology.validate(); err != nil {
+		return nil, err
+	}
+	p.set(topology)
+	return topology, nil
+}
+
+func (p *PathRoutes) set(topology *Topology) {
+	old := map[string]bool{}
+	if table, ok := p.current.Load().(*pathTable); ok {
+		for pathId := range table.topology.Paths {
+			old[pathId] = true
+		}
+	}
+
+	router := mux.NewRouter()
+	for _, pathId := range topology.pathIds() {
+		if !old[pathId] {
+			log.Printf("creating endpoint /%s\n", pathId)
+		}
+		delete(old, pathId)
+		router.Methods("POST").Path("/" + pathId).HandlerFunc(p.handler(topology, pathId))
+	}
+	for pathId := range old {
+		log.Printf("removing endpoint /%s\n", pathId)
+	}
+
+	p.current.Store(&pathTable{topology: topology, router: router})
+}
+
+func (p *PathRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.current.Load().(*pathTable).router.ServeHTTP(w, r)
+}
+
+// watchTopology reloads the topology file into routes whenever the process
+// receives SIGHUP or, if interval > 0, the file changes on disk.
+// A file that fails to load or validate is logged and the current topology is kept.
+func watchTopology(filename string, interval time.Duration, routes *PathRoutes) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+
+	lastMod := fileModTime(filename)
+	for {
+		select {
+		case <-hup:
+			log.Printf("SIGHUP received, reloading %s\n", filename)
+		case <-tick:
+			modTime := fileModTime(filename)
+			if modTime.Equal(lastMod) {
+				continue
+			}
+			log.Printf("%s changed, reloading\n", filename)
+		}
+		lastMod = fileModTime(filename)
+
+		topology, err := loadTopology(filename)
+		if err != nil {
+			log.Printf("keeping current topology: %v\n", err)
+			continue
+		}
+		routes.Set(topology)
+		log.Printf("loaded %d paths from %s\n", len(topology.Paths), filename)
+	}
+}
+
+func fileModTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Targets holds the downstream services called by /all and /random.
+// The list is replaced on every update so readers never need a lock.
+type Targets struct {
+	current atomic.Value // []string
+	mux     sync.Mutex   // serializes updates
+}
+
+func NewTargets(addrs []string) *Targets {
+	targets := &Targets{}
+	targets.current.Store(append([]string{}, addrs...))
+	return targets
+}
+
+// List returns the current downstream services; callers must not modify it
+func (t *Targets) List() []string {
+	return t.current.Load().([]string)
+}
+
+// Set replaces all downstream services
+func (t *Targets) Set(addrs []string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.current.Store(append([]string{}, addrs...))
+}
+
+// Add appends target to the downstream services, returning false if it was already present
+func (t *Targets) Add(target string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	addrs := t.List()
+	for _, addr := range addrs {
+		if addr == target {
+			return false
+		}
+	}
+	t.current.Store(append(append([]string{}, addrs...), target))
+	return true
+}
+
+// Remove drops target from the downstream services, returning false if it was not present
+func (t *Targets) Remove(target string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	addrs := t.List()
+	updated := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr != target {
+			updated = append(updated, addr)
+		}
+	}
+	if len(updated) == len(addrs) {
+		return false
+	}
+	t.current.Store(updated)
+	return true
+}
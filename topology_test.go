@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTopology(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		// err is a substring of the error expected, "" for a valid topology
+		err string
+	}{
+		{
+			name:     "linear json",
+			filename: "topology.json",
+			content:  `{"paths": {"0": {"svc-0": "svc-1", "svc-1": ""}}}`,
+		},
+		{
+			name:     "generated route map",
+			filename: "topology.json",
+			content:  `{"paths": {"0": {"svc-0": "svc-2", "svc-2": "svc-1", "svc-1": ""}, "1": {"svc-0": ""}}}`,
+		},
+		{
+			name:     "linear yaml",
+			filename: "topology.yaml",
+			content: `
+services: [svc-0, svc-1, svc-2]
+paths:
+  "0":
+    svc-0: svc-2
+    svc-2: svc-1
+    svc-1: ""
+`,
+		},
+		{
+			name:     "parallel yaml",
+			filename: "topology.yaml",
+			content: `
+services: [svc-0, svc-1, svc-2]
+paths:
+  "0":
+    svc-0:
+      mode: parallel
+      calls:
+        - svc-1
+        - target: svc-2
+          probability: 0.3
+    svc-1: ""
+    svc-2: ""
+`,
+		},
+		{
+			name:     "branch yaml",
+			filename: "topology.yml",
+			content: `
+paths:
+  "0":
+    svc-0:
+      mode: branch
+      calls:
+        - target: svc-1
+          probability: 0.8
+        - svc-2
+    svc-1: ""
+    svc-2: ""
+`,
+		},
+		{
+			name:     "no paths",
+			filename: "topology.json",
+			content:  `{"paths": {}}`,
+			err:      "no paths defined",
+		},
+		{
+			name:     "empty path",
+			filename: "topology.json",
+			content:  `{"paths": {"0": {}}}`,
+			err:      "path 0: no nodes defined",
+		},
+		{
+			name:     "unknown service",
+			filename: "topology.json",
+			content:  `{"services": ["svc-0"], "paths": {"0": {"svc-0": "svc-1", "svc-1": ""}}}`,
+			err:      "path 0: unknown node svc-1",
+		},
+		{
+			name:     "call to a node outside the path",
+			filename: "topology.json",
+			content:  `{"paths": {"0": {"svc-0": "svc-1"}}}`,
+			err:      "node svc-0 calls unknown node svc-1",
+		},
+		{
+			name:     "no terminal node",
+			filename: "topology.json",
+			content:  `{"paths": {"0": {"svc-0": "svc-1", "svc-1": "svc-0"}}}`,
+			err:      "path 0: missing terminal node",
+		},
+		{
+			name:     "cycle",
+			filename: "topology.json",
+			content:  `{"paths": {"0": {"svc-0": "svc-1", "svc-1": "svc-2", "svc-2": "svc-1", "svc-3": ""}}}`,
+			err:      "path 0: cycle through node",
+		},
+		{
+			name:     "unknown mode",
+			filename: "topology.json",
+			content:  `{"paths": {"0": {"svc-0": {"mode": "random", "calls": ["svc-1"]}, "svc-1": ""}}}`,
+			err:      "unknown mode random",
+		},
+		{
+			name:     "probability out of range",
+			filename: "topology.json",
+			content:  `{"paths": {"0": {"svc-0": {"calls": [{"target": "svc-1", "probability": 1.5}]}, "svc-1": ""}}}`,
+			err:      "out of [0, 1]",
+		},
+		{
+			name:     "branch probabilities above 1",
+			filename: "topology.json",
+			content:  `{"paths": {"0": {"svc-0": {"mode": "branch", "calls": [{"target": "svc-1", "probability": 0.7}, {"target": "svc-2", "probability": 0.7}]}, "svc-1": "", "svc-2": ""}}}`,
+			err:      "branch probabilities add up to",
+		},
+		{
+			name:     "malformed json",
+			filename: "topology.json",
+			content:  `{"paths": `,
+			err:      "parsing topology",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), test.filename)
+			if err := os.WriteFile(filename, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			topology, err := loadTopology(filename)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("loadTopology() error = %v", err)
+				}
+				if len(topology.Paths) == 0 {
+					t.Fatalf("loadTopology() loaded no paths")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("loadTopology() error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestLoadTopologyMissingFile(t *testing.T) {
+	if _, err := loadTopology(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("loadTopology() of a missing file returned no error")
+	}
+}
+
+func TestRouteMapToPaths(t *testing.T) {
+	routeMap := map[string]map[string]string{
+		"0": {"svc-0": "svc-1", "svc-1": ""},
+	}
+	topology := &Topology{Paths: routeMapToPaths(routeMap)}
+	if err := topology.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+
+	tests := []struct {
+		node    string
+		targets []string
+	}{
+		{node: "svc-0", targets: []string{"svc-1"}},
+		{node: "svc-1", targets: nil},
+	}
+	for _, test := range tests {
+		targets := getNextTarget(topology, test.node, "0").targets()
+		if strings.Join(targets, ",") != strings.Join(test.targets, ",") {
+			t.Errorf("targets of %s = %v, want %v", test.node, targets, test.targets)
+		}
+	}
+}
+
+func TestTopologyJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{name: "linear", json: `{"paths":{"0":{"svc-0":"svc-1","svc-1":""}}}`},
+		{name: "parallel", json: `{"paths":{"0":{"svc-0":{"mode":"parallel","calls":[{"target":"svc-1"},{"target":"svc-2","probability":0.5}]},"svc-1":"","svc-2":""}}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var topology Topology
+			if err := json.Unmarshal([]byte(test.json), &topology); err != nil {
+				t.Fatal(err)
+			}
+			data, err := json.Marshal(topology.clone())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.json {
+				t.Errorf("json.Marshal() = %s, want %s", data, test.json)
+			}
+		})
+	}
+}
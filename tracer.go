@@ -1,31 +1,112 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"log"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	zipkinot "github.com/openzipkin-contrib/zipkin-go-opentracing"
 	"github.com/openzipkin/zipkin-go"
 	"github.com/openzipkin/zipkin-go/model"
 	reporterhttp "github.com/openzipkin/zipkin-go/reporter/http"
+	"github.com/uber/jaeger-client-go"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+	jaegerlog "github.com/uber/jaeger-client-go/log"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+const (
+	tracerJaeger = "jaeger"
+	tracerZipkin = "zipkin"
+	tracerOtlp   = "otlp"
+	tracerNone   = "none"
 )
 
-func newTracer(serviceName string, zipkinEndpoint string, enable bool) (*zipkin.Tracer, error) {
+// newTracer builds the opentracing tracer of the given kind reporting to endpoint,
+// recording the traces chosen by policy.
+// Each tracer propagates its own format: uber-trace-id for jaeger, B3 for zipkin
+// and W3C traceparent for otlp. Closing the returned closer flushes pending spans.
+func newTracer(kind string, serviceName string, endpoint string, policy *SamplingPolicy) (opentracing.Tracer, io.Closer, error) {
+	switch kind {
+	case tracerJaeger:
+		return newJaegerTracer(serviceName, endpoint, policy)
+	case tracerZipkin:
+		return newZipkinTracer(serviceName, endpoint, policy)
+	case tracerOtlp:
+		return newOtlpTracer(serviceName, endpoint, policy)
+	case tracerNone:
+		return opentracing.NoopTracer{}, closerFunc(func() error { return nil }), nil
+	}
+	return nil, nil, fmt.Errorf("unknown tracer %s", kind)
+}
+
+// newJaegerTracer reports to the jaeger-agent at agentEndpoint (host:port, UDP)
+func newJaegerTracer(serviceName string, agentEndpoint string, policy *SamplingPolicy) (opentracing.Tracer, io.Closer, error) {
+	// Enable LogSpan to log every span via configured Logger.
+	cfg := jaegercfg.Configuration{
+		ServiceName: serviceName,
+		//LocalAgentHostPort instructs reporter to send spans to jaeger-agent at this address. Can be provided by FromEnv() via the environment variable named JAEGER_AGENT_HOST / JAEGER_AGENT_PORT
+		Reporter: &jaegercfg.ReporterConfig{
+			LogSpans:           true,
+			LocalAgentHostPort: agentEndpoint,
+		},
+	}
+
+	// Example logger and metrics factory. Use github.com/uber/jaeger-client-go/log
+	// and github.com/uber/jaeger-lib/metrics respectively to bind to real logging and metrics
+	// frameworks.
+	jLogger := jaegerlog.StdLogger
+	jMetricsFactory := metrics.NullFactory
+
+	// Initialize tracer with a logger and a metrics factory
+	return cfg.NewTracer(
+		jaegercfg.Logger(jLogger),
+		jaegercfg.Metrics(jMetricsFactory),
+		jaegercfg.Sampler(&jaegerSampler{policy: policy}),
+		// keeping a failed or slow span must not turn it into a debug span
+		jaegercfg.NoDebugFlagOnForcedSampling(true),
+	)
+}
+
+// jaegerSampler samples the traces started by this service with policy,
+// the operation name of a span is its endpoint
+type jaegerSampler struct {
+	policy *SamplingPolicy
+}
+
+func (s *jaegerSampler) IsSampled(id jaeger.TraceID, operation string) (bool, []jaeger.Tag) {
+	sampled, rule := s.policy.Sample(operation)
+	return sampled, []jaeger.Tag{jaeger.NewTag(samplingRuleTag, rule)}
+}
+
+func (s *jaegerSampler) Close() {}
+
+func (s *jaegerSampler) Equal(other jaeger.Sampler) bool {
+	return s == other
+}
+
+// newZipkinTracer reports to the zipkin server at zipkinEndpoint (host:port, HTTP)
+func newZipkinTracer(serviceName string, zipkinEndpoint string, policy *SamplingPolicy) (opentracing.Tracer, io.Closer, error) {
 	endpointURL := "http://" + zipkinEndpoint + "/api/v2/spans"
 
 	// The reporter sends traces to zipkin server
 	reporter := reporterhttp.NewReporter(endpointURL)
 
 	// Local endpoint represent the local service information
-	localEndpoint := &model.Endpoint{ServiceName: serviceName, Port: 8080}
-
-	// Sampler tells you which traces are going to be sampled or not. In
-	// this case we will record 100% (1.00) of traces
-  samplingRate := 0.00
-  if enable {
-    samplingRate = 1.00
-  }
-
+	localEndpoint := &model.Endpoint{ServiceName: serviceName, Port: uint16(port)}
 
-  sampler, err := zipkin.NewCountingSampler(samplingRate)
-	if err != nil {
-		return nil, err
+	// Sampler tells you which traces are going to be sampled or not.
+	// zipkin samplers only see the trace id, so every endpoint uses the default rule
+	if policy.PerEndpoint() {
+		log.Println("the zipkin tracer ignores per endpoint sampling rules")
+	}
+	if policy.Tail() {
+		log.Println("the zipkin tracer cannot keep failed or slow spans that were not sampled")
+	}
+	sampler := func(id uint64) bool {
+		sampled, _ := policy.Sample("")
+		return sampled
 	}
 
 	t, err := zipkin.NewTracer(
@@ -33,10 +114,16 @@ func newTracer(serviceName string, zipkinEndpoint string, enable bool) (*zipkin.
 		zipkin.WithSampler(sampler),
 		zipkin.WithLocalEndpoint(localEndpoint),
 	)
-
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return t, err
+	// the opentracing wrapper propagates B3 headers
+	return zipkinot.Wrap(t), reporter, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
 }
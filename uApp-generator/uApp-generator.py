@@ -281,6 +281,11 @@ class Kubernetes:
                     'metadata': {
                         'labels': {
                             'app': name
+                        },
+                        'annotations': {
+                            'prometheus.io/scrape': 'true',
+                            'prometheus.io/port': '8080',
+                            'prometheus.io/path': '/metrics'
                         }
                     },
                     'spec': {
@@ -328,7 +333,9 @@ class Kubernetes:
                             ] + args['childs'],
                             'env': [
                                 {'name': 'ZIPKIN',
-                                'value': 'opentrace-jaeger-svc.default.svc.cluster.local'}
+                                'value': 'opentrace-jaeger-svc.default.svc.cluster.local'},
+                                {'name': 'POD_NAME',
+                                'valueFrom': {'fieldRef': {'fieldPath': 'metadata.name'}}}
                             ]
                             ,
                             'envFrom': [
@@ -553,3 +560,7 @@ if __name__=="__main__":
     with open('../routeMap.go', 'w') as outfile:
         outfile.write("package main\nvar generatedRouteMap = map[string]map[string]string")
         json.dump(routeMap, outfile)
+
+    # Write the same routemap as a topology file that can be loaded with --topology
+    with open('generated/topology.json', 'w') as outfile:
+        json.dump({'paths': routeMap}, outfile)
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"math"
+	"runtime"
+	"time"
+)
+
+const (
+	cpuWorkHash = "hash"
+	cpuWorkSpin = "spin"
+	cpuWorkNone = "none"
+)
+
+var (
+	cpuWork    string
+	maxCpuTime time.Duration
+	// spinSink keeps the compiler from optimizing the spin loop away
+	spinSink uint64
+)
+
+// cpuTimePerRequest derives the CPU time spent processing one message from the
+// processing time (ms) and the load returned by getCpuUsage. The processing
+// time is the cost under the worst load (0); the best load (1) costs nothing.
+// The result is scaled by the current factor of the CPU load profile.
+func cpuTimePerRequest(processTime float64, load float64) time.Duration {
+	if math.IsNaN(load) {
+		load = 0
+	}
+	load = math.Max(0, math.Min(1, load))
+
+	cpuTime := time.Duration(processTime * (1 - load) * cpuProfileFactor() * float64(time.Millisecond))
+	if maxCpuTime > 0 && cpuTime > maxCpuTime {
+		cpuTime = maxCpuTime
+	}
+	return cpuTime
+}
+
+// burnCpu keeps the calling goroutine busy until it has used cpuTime of CPU
+// or ctx is done, and returns the CPU time actually used. The work is done in
+// small chunks so a cancelled request stops burning CPU almost immediately.
+// Where the CPU time of a thread cannot be read, wall-clock time is used instead.
+func burnCpu(ctx context.Context, cpuTime time.Duration) time.Duration {
+	if cpuWork == cpuWorkNone || cpuTime <= 0 {
+		return 0
+	}
+
+	// keep the goroutine on one thread so the thread CPU time is ours
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	elapsed := threadCpuTime
+	if _, ok := threadCpuTime(); !ok {
+		elapsed = wallClockTime
+	}
+	start, _ := elapsed()
+
+	var buf [sha256.Size]byte
+	for {
+		select {
+		case <-ctx.Done():
+			now, _ := elapsed()
+			return now - start
+		default:
+		}
+
+		if cpuWork == cpuWorkSpin {
+			for i := uint64(0); i < 20000; i++ {
+				spinSink += i * i
+			}
+		} else {
+			for i := 0; i < 100; i++ {
+				buf = sha256.Sum256(buf[:])
+			}
+		}
+
+		now, _ := elapsed()
+		if now-start >= cpuTime {
+			return now - start
+		}
+	}
+}
+
+func wallClockTime() (time.Duration, bool) {
+	return time.Duration(time.Now().UnixNano()), true
+}